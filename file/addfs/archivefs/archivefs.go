@@ -0,0 +1,180 @@
+// Package archivefs provides addfs.PerNodeFuncs that expand archive files (tar, zip, gzip) into
+// navigable fsnode.Parent trees, without reading the whole archive up front.
+package archivefs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/grailbio/base/file/addfs"
+	"github.com/grailbio/base/file/fsnode"
+	"github.com/grailbio/base/ioctx"
+	"github.com/grailbio/base/ioctx/fsctx"
+)
+
+// contentsDirName is the name of the directory, under the archive file's node, that holds the
+// expanded archive contents. For example, expanding archive.tar yields .../archive.tar/contents/.
+const contentsDirName = "contents"
+
+// ArchivePerNodeFunc returns an addfs.PerNodeFunc that recognizes tar, zip, and gzip files (by
+// extension, falling back to sniffing the first few bytes read through the node, if it's a
+// fsnode.Leaf) and expands each into a contents/ directory using TarPerNodeFunc, ZipPerNodeFunc,
+// or GzipPerNodeFunc, as appropriate. Nodes that don't look like a supported archive are left
+// untouched (no additions, no error).
+func ArchivePerNodeFunc() addfs.PerNodeFunc {
+	tar := TarPerNodeFunc()
+	zip := ZipPerNodeFunc()
+	gzip := GzipPerNodeFunc()
+	return addfs.NewPerNodeFunc(func(ctx context.Context, n fsnode.T) ([]fsnode.T, error) {
+		switch detectFormat(ctx, n) {
+		case formatTar:
+			return tar.Apply(ctx, n)
+		case formatZip:
+			return zip.Apply(ctx, n)
+		case formatGzip:
+			return gzip.Apply(ctx, n)
+		default:
+			return nil, nil
+		}
+	})
+}
+
+type format int
+
+const (
+	formatNone format = iota
+	formatTar
+	formatZip
+	formatGzip
+)
+
+// detectFormat identifies n's archive format, preferring the file extension (cheap, and correct
+// for the common case of a gzipped tar, which can't be told apart from a bare gzip stream by
+// magic bytes alone) and falling back to sniffing the leading bytes of a fsnode.Leaf's contents.
+func detectFormat(ctx context.Context, n fsnode.T) format {
+	name := n.Info().Name()
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return formatTar
+	case strings.HasSuffix(name, ".zip"):
+		return formatZip
+	case strings.HasSuffix(name, ".gz"), strings.HasSuffix(name, ".tgz"):
+		return formatGzip
+	}
+	leaf, ok := n.(fsnode.Leaf)
+	if !ok {
+		return formatNone
+	}
+	magic, err := sniff(ctx, leaf, 262)
+	if err != nil {
+		return formatNone
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return formatGzip
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return formatZip
+	case looksLikeTar(magic):
+		return formatTar
+	default:
+		return formatNone
+	}
+}
+
+// looksLikeTar checks for the "ustar" magic at offset 257, present in all but the oldest,
+// pre-POSIX tar files. We don't try to support those.
+func looksLikeTar(header []byte) bool {
+	const (
+		magicOffset = 257
+		magicLen    = 5
+	)
+	if len(header) < magicOffset+magicLen {
+		return false
+	}
+	return bytes.Equal(header[magicOffset:magicOffset+magicLen], []byte("ustar"))
+}
+
+func sniff(ctx context.Context, leaf fsnode.Leaf, n int) ([]byte, error) {
+	f, err := fsnode.Open(ctx, leaf)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close(ctx) }()
+	buf := make([]byte, n)
+	m, err := io.ReadFull(ioctx.ToStdReader(ctx, f), buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return buf[:m], nil
+}
+
+// trimArchiveExt strips name's last extension (e.g. foo.tar.gz -> foo.tar). GzipPerNodeFunc uses
+// it to name the decompressed entry when the gzip header records no original name.
+func trimArchiveExt(name string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext)
+}
+
+// errf wraps an error with the archivefs package's error prefix, following the addfs convention
+// of tagging errors with their originating package.
+func errf(format string, args ...interface{}) error {
+	return fmt.Errorf("archivefs: "+format, args...)
+}
+
+// openLeaf opens leaf for reading and adapts the result to a plain io.ReadCloser, for use with
+// stdlib archive readers (archive/tar, archive/zip, compress/gzip) that expect one.
+func openLeaf(ctx context.Context, leaf fsnode.Leaf) (io.ReadCloser, error) {
+	f, err := fsnode.Open(ctx, leaf)
+	if err != nil {
+		return nil, err
+	}
+	return ioctx.ToStdReadCloser(ctx, f), nil
+}
+
+// leafFromOpener constructs a fsnode.Leaf via fsnode.FuncLeaf, wrapping an open function that
+// returns a fresh io.ReadCloser for the leaf's content each time it's called. This is the shape
+// tar, zip, and gzip entries naturally open in (via archive/tar, archive/zip, compress/gzip, all
+// of which hand back io.Reader-family types), so it's shared across this package's Leaf
+// constructions rather than repeating the fsctx.File adaptation in each.
+func leafFromOpener(info fsnode.FileInfo, open func(ctx context.Context) (io.ReadCloser, error)) fsnode.Leaf {
+	return fsnode.FuncLeaf(info, func(ctx context.Context, _ int) (fsctx.File, error) {
+		rc, err := open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &readCloserFile{rc: rc, info: info}, nil
+	})
+}
+
+// readCloserFile adapts an io.ReadCloser to fsctx.File.
+type readCloserFile struct {
+	rc   io.ReadCloser
+	info fsnode.FileInfo
+}
+
+func (f *readCloserFile) Stat(context.Context) (os.FileInfo, error) { return f.info, nil }
+func (f *readCloserFile) Read(_ context.Context, dst []byte) (int, error) {
+	return f.rc.Read(dst)
+}
+func (f *readCloserFile) Close(context.Context) error { return f.rc.Close() }
+
+// sanitizeArchivePath cleans an archive entry's path and rejects ones that would escape the
+// archive root once joined with a destination directory (a "zip-slip" path), e.g. "../etc/passwd"
+// or an absolute path. Both TarPerNodeFunc and ZipPerNodeFunc reject such entries rather than
+// exposing them, since nothing downstream should have to re-derive this check.
+func sanitizeArchivePath(name string) (string, error) {
+	cleaned := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	cleaned = strings.TrimPrefix(cleaned, "/")
+	if cleaned == "." {
+		return "", errf("empty entry path")
+	}
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") || path.IsAbs(name) {
+		return "", errf("entry path %q escapes archive root", name)
+	}
+	return cleaned, nil
+}
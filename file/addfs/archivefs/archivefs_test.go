@@ -0,0 +1,243 @@
+package archivefs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/grailbio/base/file/fsnode"
+	"github.com/grailbio/base/ioctx"
+)
+
+func newMemLeaf(name string, data []byte) fsnode.Leaf {
+	return fsnode.ConstLeaf(fsnode.NewRegInfo(name), data)
+}
+
+func readLeaf(ctx context.Context, t *testing.T, leaf fsnode.Leaf) []byte {
+	t.Helper()
+	f, err := fsnode.Open(ctx, leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close(ctx) }()
+	got, err := io.ReadAll(ioctx.ToStdReader(ctx, f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func mustChild(t *testing.T, ctx context.Context, p fsnode.Parent, name string) fsnode.T {
+	t.Helper()
+	n, err := p.Child(ctx, name)
+	if err != nil {
+		t.Fatalf("Child(%q): %v", name, err)
+	}
+	return n
+}
+
+func TestTarPerNodeFunc(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	files := map[string]string{
+		"dir/fileA": "hello",
+		"dir/fileB": "world",
+	}
+	for _, name := range []string{"dir/fileA", "dir/fileB"} {
+		data := files[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(data)), Mode: 0644}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	adds, err := TarPerNodeFunc().Apply(ctx, newMemLeaf("archive.tar", buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adds) != 1 {
+		t.Fatalf("got %d adds, want 1", len(adds))
+	}
+	contents := adds[0].(fsnode.Parent)
+	dir := mustChild(t, ctx, contents, "dir").(fsnode.Parent)
+	leaf := mustChild(t, ctx, dir, "fileA").(fsnode.Leaf)
+	got := readLeaf(ctx, t, leaf)
+	if string(got) != "hello" {
+		t.Errorf("got content %q, want %q", got, "hello")
+	}
+}
+
+func TestTarPerNodeFunc_RejectsZipSlip(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	data := []byte("evil")
+	if err := tw.WriteHeader(&tar.Header{Name: "../../etc/passwd", Size: int64(len(data)), Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = tw.Write(data)
+	_ = tw.Close()
+
+	adds, err := TarPerNodeFunc().Apply(ctx, newMemLeaf("evil.tar", buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := adds[0].(fsnode.Parent)
+	it := contents.Children()
+	if _, err := it.Next(ctx); err == nil {
+		t.Fatal("expected error reading past a zip-slip entry, got nil")
+	}
+}
+
+func TestTarPerNodeFunc_RejectsCyclicSymlink(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	headers := []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b"},
+		{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a"},
+	}
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = tw.Close()
+
+	adds, err := TarPerNodeFunc().Apply(ctx, newMemLeaf("cyclic.tar", buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := adds[0].(fsnode.Parent)
+	it := contents.Children()
+	sawErr := false
+	for i := 0; i < 3; i++ {
+		if _, err := it.Next(ctx); err != nil {
+			if err != io.EOF {
+				sawErr = true
+			}
+			break
+		}
+	}
+	if !sawErr {
+		t.Fatal("expected an error surfaced for the cyclic symlink pair, got none")
+	}
+}
+
+func TestTarPerNodeFunc_RejectsTruncated(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	data := []byte("this is a full file's worth of content")
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Size: int64(len(data)), Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = tw.Write(data)
+	// Deliberately don't call tw.Close, then truncate partway through the file's content to
+	// simulate a corrupted upload.
+	truncated := buf.Bytes()[:len(buf.Bytes())-10]
+
+	adds, err := TarPerNodeFunc().Apply(ctx, newMemLeaf("truncated.tar", truncated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := adds[0].(fsnode.Parent)
+	leaf, err := contents.Child(ctx, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsnode.Open(ctx, leaf.(fsnode.Leaf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close(ctx) }()
+	if _, err := io.ReadAll(ioctx.ToStdReader(ctx, f)); err == nil {
+		t.Fatal("expected an error reading truncated tar content, got nil")
+	}
+}
+
+func TestZipPerNodeFunc_RejectsZipSlip(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("../../etc/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("evil"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ZipPerNodeFunc().Apply(ctx, newMemLeaf("evil.zip", buf.Bytes())); err == nil {
+		t.Fatal("expected error for zip-slip entry, got nil")
+	}
+}
+
+func TestZipPerNodeFunc_ExplicitDirEntry(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if _, err := zw.Create("dir/"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := zw.Create("dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("hello"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	adds, err := ZipPerNodeFunc().Apply(ctx, newMemLeaf("archive.zip", buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := adds[0].(fsnode.Parent)
+	dirNode := mustChild(t, ctx, contents, "dir")
+	dir, ok := dirNode.(fsnode.Parent)
+	if !ok {
+		t.Fatalf("dir: got %T, want fsnode.Parent", dirNode)
+	}
+	leaf := mustChild(t, ctx, dir, "file").(fsnode.Leaf)
+	got := readLeaf(ctx, t, leaf)
+	if string(got) != "hello" {
+		t.Errorf("got content %q, want %q", got, "hello")
+	}
+}
+
+func TestZipPerNodeFunc(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("hello"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	adds, err := ZipPerNodeFunc().Apply(ctx, newMemLeaf("archive.zip", buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := adds[0].(fsnode.Parent)
+	dir := mustChild(t, ctx, contents, "dir").(fsnode.Parent)
+	leaf := mustChild(t, ctx, dir, "file").(fsnode.Leaf)
+	got := readLeaf(ctx, t, leaf)
+	if string(got) != "hello" {
+		t.Errorf("got content %q, want %q", got, "hello")
+	}
+}
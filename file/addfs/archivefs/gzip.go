@@ -0,0 +1,119 @@
+package archivefs
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/grailbio/base/file/addfs"
+	"github.com/grailbio/base/file/fsnode"
+	"github.com/grailbio/base/ioctx"
+)
+
+// GzipPerNodeFunc returns an addfs.PerNodeFunc that recognizes gzip-compressed files (fsnode.Leaf
+// nodes) and adds a "contents" directory containing a single decompressed fsnode.Leaf. Unlike tar
+// and zip, gzip compresses a single stream rather than an archive of entries, so there's nothing
+// to list lazily: the one synthetic entry is cheap to describe, and its content is decompressed
+// on demand when actually read.
+//
+// A gzip member optionally records the original filename; when present, it's used as the
+// decompressed entry's name. Otherwise the name is derived by trimming a trailing .gz/.tgz
+// extension from the gzip file's own name (foo.tar.gz -> foo.tar, foo.tgz -> foo.tar).
+//
+// Composing this with TarPerNodeFunc (e.g. via ArchivePerNodeFunc, which applies both) is what
+// lets users navigate into a .tar.gz: addfs re-applies the PerNodeFuncs to this func's output, so
+// the decompressed archive.tar leaf picks up its own .../ with TarPerNodeFunc's additions, i.e.
+// .../archive.tar.gz/contents/.../archive.tar/contents/.
+func GzipPerNodeFunc() addfs.PerNodeFunc {
+	return addfs.NewPerNodeFunc(func(ctx context.Context, n fsnode.T) ([]fsnode.T, error) {
+		leaf, ok := n.(fsnode.Leaf)
+		if !ok {
+			return nil, nil
+		}
+		name, err := gzipEntryName(ctx, leaf)
+		if err != nil {
+			return nil, err
+		}
+		entry := leafFromOpener(
+			fsnode.NewRegInfo(name).WithModTime(n.Info().ModTime()),
+			func(ctx context.Context) (io.ReadCloser, error) { return newGzipReadCloser(ctx, leaf) },
+		)
+		contents := &gzipDir{
+			FileInfo: fsnode.NewDirInfo(contentsDirName).WithCacheableFor(fsnode.CacheableFor(n)),
+			entry:    entry,
+		}
+		return []fsnode.T{contents}, nil
+	})
+}
+
+func gzipEntryName(ctx context.Context, leaf fsnode.Leaf) (string, error) {
+	f, err := fsnode.Open(ctx, leaf)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close(ctx) }()
+	zr, err := gzip.NewReader(ioctx.ToStdReader(ctx, f))
+	if err != nil {
+		return "", errf("opening gzip: %w", err)
+	}
+	defer zr.Close()
+	if zr.Name != "" {
+		return zr.Name, nil
+	}
+	name := leaf.Info().Name()
+	if strings.HasSuffix(name, ".tgz") {
+		return strings.TrimSuffix(name, ".tgz") + ".tar", nil
+	}
+	return trimArchiveExt(name), nil
+}
+
+func newGzipReadCloser(ctx context.Context, leaf fsnode.Leaf) (io.ReadCloser, error) {
+	f, err := fsnode.Open(ctx, leaf)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(ioctx.ToStdReader(ctx, f))
+	if err != nil {
+		_ = f.Close(ctx)
+		return nil, errf("opening gzip: %w", err)
+	}
+	return gzipReadCloser{zr, ioctx.ToStdCloser(ctx, f)}, nil
+}
+
+// gzipReadCloser closes both the gzip reader and the underlying raw reader it wraps.
+type gzipReadCloser struct {
+	*gzip.Reader
+	raw io.Closer
+}
+
+func (g gzipReadCloser) Close() error {
+	err := g.Reader.Close()
+	if rawErr := g.raw.Close(); err == nil {
+		err = rawErr
+	}
+	return err
+}
+
+// gzipDir is the single-entry "contents" directory placed under a gzip file's node.
+type gzipDir struct {
+	fsnode.ParentReadOnly
+	fsnode.FileInfo
+	entry fsnode.T
+}
+
+var (
+	_ fsnode.Parent    = (*gzipDir)(nil)
+	_ fsnode.Cacheable = (*gzipDir)(nil)
+)
+
+func (d *gzipDir) FSNodeT() {}
+
+func (d *gzipDir) Child(ctx context.Context, name string) (fsnode.T, error) {
+	if name == d.entry.Info().Name() {
+		return d.entry, nil
+	}
+	return nil, os.ErrNotExist
+}
+func (d *gzipDir) Children() fsnode.Iterator { return fsnode.NewIterator(d.entry) }
@@ -0,0 +1,340 @@
+package archivefs
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/file/addfs"
+	"github.com/grailbio/base/file/fsnode"
+)
+
+// TarPerNodeFunc returns an addfs.PerNodeFunc that recognizes tar files (fsnode.Leaf nodes) and
+// adds a "contents" directory exposing the archive's entries as a navigable fsnode.Parent tree.
+// The tar stream is read incrementally: only as many header records as are needed to answer a
+// given Child or Children call are read, and they're buffered so that later calls don't re-read
+// parts of the stream they've already seen.
+func TarPerNodeFunc() addfs.PerNodeFunc {
+	return addfs.NewPerNodeFunc(func(ctx context.Context, n fsnode.T) ([]fsnode.T, error) {
+		leaf, ok := n.(fsnode.Leaf)
+		if !ok {
+			return nil, nil
+		}
+		tree := &tarTree{leaf: leaf}
+		contents := &tarDir{
+			FileInfo: fsnode.NewDirInfo(contentsDirName).WithCacheableFor(fsnode.CacheableFor(n)),
+			tree:     tree,
+			dir:      "",
+		}
+		return []fsnode.T{contents}, nil
+	})
+}
+
+// tarEntry is a tar header record that tarTree has read, along with its position (entryIndex)
+// among all headers read so far. entryIndex lets us re-derive a reader for the entry's content on
+// demand, by replaying the tar stream from the start up to that position; tar doesn't support
+// random access, so this is the closest we can get to "seek-on-demand" for it.
+type tarEntry struct {
+	header     *tar.Header
+	entryIndex int
+	path       string // cleaned, slash-separated, relative, no leading "./"
+}
+
+// tarTree incrementally scans a tar stream, caching every header it has read so far so that
+// repeated navigation doesn't have to re-scan from the beginning. It's shared by every node
+// (directory or file) produced from a single archive.
+type tarTree struct {
+	leaf fsnode.Leaf
+
+	mu      sync.Mutex
+	rc      io.ReadCloser
+	tr      *tar.Reader
+	byPath  map[string]*tarEntry
+	order   []*tarEntry
+	nextIdx int
+	eof     bool
+	err     error
+}
+
+// advance reads and caches the next tar header, if any. It returns (nil, nil) at end of archive.
+func (t *tarTree) advance(ctx context.Context) (*tarEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.eof {
+		return nil, nil
+	}
+	if t.tr == nil {
+		rc, err := openLeaf(ctx, t.leaf)
+		if err != nil {
+			return nil, err
+		}
+		t.rc = rc
+		t.tr = tar.NewReader(rc)
+		t.byPath = make(map[string]*tarEntry)
+	}
+	hdr, err := t.tr.Next()
+	if err == io.EOF {
+		t.eof = true
+		_ = t.rc.Close()
+		return nil, nil
+	}
+	if err != nil {
+		t.err = errf("reading tar entry %d: %w", t.nextIdx, err)
+		_ = t.rc.Close()
+		return nil, t.err
+	}
+	p, err := sanitizeArchivePath(hdr.Name)
+	if err != nil {
+		t.err = err
+		_ = t.rc.Close()
+		return nil, t.err
+	}
+	e := &tarEntry{header: hdr, entryIndex: t.nextIdx, path: p}
+	t.nextIdx++
+	t.byPath[p] = e
+	t.order = append(t.order, e)
+	if hdr.Typeflag == tar.TypeSymlink {
+		if err := checkNoSymlinkCycle(e, t.byPath); err != nil {
+			t.err = err
+			_ = t.rc.Close()
+			return nil, t.err
+		}
+	}
+	return e, nil
+}
+
+// find returns the entry at p, scanning further into the stream as needed. It returns (nil, nil)
+// if p is not present anywhere in the archive.
+func (t *tarTree) find(ctx context.Context, p string) (*tarEntry, error) {
+	t.mu.Lock()
+	if e, ok := t.byPath[p]; ok {
+		t.mu.Unlock()
+		return e, nil
+	}
+	t.mu.Unlock()
+	for {
+		e, err := t.advance(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil { // eof
+			return nil, nil
+		}
+		if e.path == p {
+			return e, nil
+		}
+	}
+}
+
+// cachedUnder returns the already-scanned entries that are direct children of dir, in the order
+// they were read.
+func (t *tarTree) cachedUnder(dir string) []*tarEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []*tarEntry
+	for _, e := range t.order {
+		if isDirectChild(dir, e.path) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// contentReader replays the tar stream from the beginning up to e's position and returns a
+// reader limited to e's content. This is the "seek-on-demand" materialization for tar: there's no
+// cheaper way to get random access into a sequential format.
+func (t *tarTree) contentReader(ctx context.Context, e *tarEntry) (io.ReadCloser, error) {
+	rc, err := openLeaf(ctx, t.leaf)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(rc)
+	for i := 0; i <= e.entryIndex; i++ {
+		hdr, err := tr.Next()
+		if err != nil {
+			_ = rc.Close()
+			return nil, errf("replaying tar stream to entry %q: %w", e.path, err)
+		}
+		if i == e.entryIndex {
+			if hdr.Typeflag == tar.TypeLink {
+				_ = rc.Close()
+				target, err := t.find(ctx, hdr.Linkname)
+				if err != nil {
+					return nil, err
+				}
+				if target == nil {
+					return nil, errf("hardlink %q: target %q not found", e.path, hdr.Linkname)
+				}
+				return t.contentReader(ctx, target)
+			}
+			break
+		}
+	}
+	return limitedReadCloser{io.LimitReader(tr, e.header.Size), rc}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// tarDir is a directory within a tar archive. Its Children iterate the underlying tarTree lazily,
+// and its Child looks up a single name without reading the rest of the directory's entries.
+type tarDir struct {
+	fsnode.ParentReadOnly
+	fsnode.FileInfo
+	tree *tarTree
+	dir  string
+}
+
+var (
+	_ fsnode.Parent    = (*tarDir)(nil)
+	_ fsnode.Cacheable = (*tarDir)(nil)
+)
+
+func (d *tarDir) FSNodeT() {}
+
+func (d *tarDir) Child(ctx context.Context, name string) (fsnode.T, error) {
+	return tarDirChild(ctx, d.tree, d.dir, name)
+}
+func (d *tarDir) Children() fsnode.Iterator {
+	return &tarDirIterator{tree: d.tree, dir: d.dir}
+}
+
+type tarDirIterator struct {
+	tree    *tarTree
+	dir     string
+	cached  []*tarEntry
+	emitted map[string]bool
+}
+
+func (it *tarDirIterator) Next(ctx context.Context) (fsnode.T, error) {
+	if it.emitted == nil {
+		it.emitted = make(map[string]bool)
+		it.cached = it.tree.cachedUnder(it.dir)
+	}
+	for len(it.cached) > 0 {
+		e := it.cached[0]
+		it.cached = it.cached[1:]
+		if it.emitted[e.path] {
+			continue
+		}
+		it.emitted[e.path] = true
+		return entryToNode(it.tree, e), nil
+	}
+	for {
+		e, err := it.tree.advance(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			return nil, io.EOF
+		}
+		if isDirectChild(it.dir, e.path) && !it.emitted[e.path] {
+			it.emitted[e.path] = true
+			return entryToNode(it.tree, e), nil
+		}
+	}
+}
+
+func (it *tarDirIterator) Close(context.Context) error { return nil }
+
+// Child looks up name directly, without reading the rest of dir's entries.
+func tarDirChild(ctx context.Context, tree *tarTree, dir, name string) (fsnode.T, error) {
+	p := path.Join(dir, name)
+	e, err := tree.find(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if e != nil {
+		return entryToNode(tree, e), nil
+	}
+	// The archive may have no explicit header for an intermediate directory; if anything under
+	// p exists, treat p as an implicit directory.
+	if hasDescendant(tree, p) {
+		return newTarDir(tree, p, fsnode.NewDirInfo(name)), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func hasDescendant(tree *tarTree, dir string) bool {
+	prefix := dir + "/"
+	tree.mu.Lock()
+	for _, e := range tree.order {
+		if strings.HasPrefix(e.path, prefix) {
+			tree.mu.Unlock()
+			return true
+		}
+	}
+	tree.mu.Unlock()
+	return false
+}
+
+func entryToNode(tree *tarTree, e *tarEntry) fsnode.T {
+	name := path.Base(e.path)
+	switch e.header.Typeflag {
+	case tar.TypeDir:
+		return newTarDir(tree, e.path, fsnode.NewDirInfo(name).WithModTime(e.header.ModTime).WithModePerm(e.header.FileInfo().Mode().Perm()))
+	case tar.TypeSymlink:
+		info := fsnode.NewSymlinkInfo(name).WithModTime(e.header.ModTime)
+		return fsnode.ConstLeaf(info, []byte(e.header.Linkname))
+	default: // regular files and hardlinks, which resolve to regular content.
+		info := fsnode.NewRegInfo(name).
+			WithModTime(e.header.ModTime).
+			WithModePerm(e.header.FileInfo().Mode().Perm()).
+			WithSize(e.header.Size)
+		return leafFromOpener(info, func(ctx context.Context) (io.ReadCloser, error) {
+			return tree.contentReader(ctx, e)
+		})
+	}
+}
+
+func newTarDir(tree *tarTree, dir string, info fsnode.FileInfo) fsnode.Parent {
+	// Derived directory must be executable to be usable, even if the tar entry wasn't.
+	return &tarDir{FileInfo: info.WithModePerm(info.Mode().Perm() | 0111), tree: tree, dir: dir}
+}
+
+// isDirectChild reports whether p is an immediate child path of dir ("" for the archive root).
+func isDirectChild(dir, p string) bool {
+	rel := p
+	if dir != "" {
+		prefix := dir + "/"
+		if !strings.HasPrefix(p, prefix) {
+			return false
+		}
+		rel = strings.TrimPrefix(p, prefix)
+	}
+	return rel != "" && !strings.Contains(rel, "/")
+}
+
+// checkNoSymlinkCycle rejects a symlink entry whose target chain (as far as we've scanned) loops
+// back to itself. We can only see entries read so far, so this catches the common "a -> a" and
+// "a -> b -> a" shapes, not every possible cycle, but it's enough to reject the malformed
+// archives this function exists to guard against.
+func checkNoSymlinkCycle(start *tarEntry, byPath map[string]*tarEntry) error {
+	seen := map[string]bool{start.path: true}
+	cur := start
+	for i := 0; i < len(byPath)+1; i++ {
+		if cur.header.Typeflag != tar.TypeSymlink {
+			return nil
+		}
+		target := path.Clean(path.Join(path.Dir(cur.path), cur.header.Linkname))
+		if seen[target] {
+			return errf("cyclic symlink at %q", start.path)
+		}
+		next, ok := byPath[target]
+		if !ok {
+			return nil // target not (yet) known; nothing more we can check.
+		}
+		seen[target] = true
+		cur = next
+	}
+	return errf("cyclic symlink at %q", start.path)
+}
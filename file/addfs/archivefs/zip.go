@@ -0,0 +1,210 @@
+package archivefs
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/grailbio/base/file/addfs"
+	"github.com/grailbio/base/file/fsnode"
+)
+
+// ZipPerNodeFunc returns an addfs.PerNodeFunc that recognizes zip files (fsnode.Leaf nodes) and
+// adds a "contents" directory exposing the archive's entries as a navigable fsnode.Parent tree.
+// The archive is read into memory in full when the func is applied (see readerAt), and its
+// central directory is then used to list entries; the central directory is not read on its own.
+func ZipPerNodeFunc() addfs.PerNodeFunc {
+	return addfs.NewPerNodeFunc(func(ctx context.Context, n fsnode.T) ([]fsnode.T, error) {
+		leaf, ok := n.(fsnode.Leaf)
+		if !ok {
+			return nil, nil
+		}
+		index, err := newZipIndex(ctx, leaf)
+		if err != nil {
+			return nil, err
+		}
+		contents := &zipDir{
+			FileInfo: fsnode.NewDirInfo(contentsDirName).WithCacheableFor(fsnode.CacheableFor(n)),
+			index:    index,
+			dir:      "",
+		}
+		return []fsnode.T{contents}, nil
+	})
+}
+
+// zipIndex holds a zip archive's central directory, read once when ZipPerNodeFunc is applied and
+// then reused for every Child/Children call against the expanded tree.
+type zipIndex struct {
+	leaf    fsnode.Leaf
+	byPath  map[string]*zip.File
+	under   map[string][]string // dir -> direct child paths, including implicit directories
+	entries []string             // insertion order, for stable iteration
+}
+
+func newZipIndex(ctx context.Context, leaf fsnode.Leaf) (*zipIndex, error) {
+	ra, size, closeRA, err := readerAt(ctx, leaf)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRA()
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, errf("opening zip: %w", err)
+	}
+	idx := &zipIndex{
+		leaf:   leaf,
+		byPath: make(map[string]*zip.File, len(zr.File)),
+		under:  make(map[string][]string),
+	}
+	for _, f := range zr.File {
+		p, err := sanitizeArchivePath(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		p = strings.TrimSuffix(p, "/")
+		if _, exists := idx.byPath[p]; exists {
+			continue
+		}
+		idx.byPath[p] = f
+		idx.entries = append(idx.entries, p)
+		idx.addAncestors(p)
+	}
+	return idx, nil
+}
+
+// addAncestors records p, and every ancestor directory of p, in idx.under so that Children can
+// enumerate implicit directories (zip files routinely omit explicit directory entries).
+func (idx *zipIndex) addAncestors(p string) {
+	for {
+		dir := path.Dir(p)
+		if dir == "." {
+			dir = ""
+		}
+		if !contains(idx.under[dir], p) {
+			idx.under[dir] = append(idx.under[dir], p)
+		}
+		if dir == "" || p == dir {
+			return
+		}
+		p = dir
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readerAt adapts a fsnode.Leaf to an io.ReaderAt, which archive/zip requires. The reader
+// openLeaf returns never implements io.ReaderAt, so the io.ReaderAt branch below is not taken and
+// the whole archive is buffered in memory, whatever the leaf's own file supports.
+func readerAt(ctx context.Context, leaf fsnode.Leaf) (io.ReaderAt, int64, func(), error) {
+	r, err := openLeaf(ctx, leaf)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if ra, ok := r.(io.ReaderAt); ok {
+		size := leaf.Info().Size()
+		return ra, size, func() { _ = r.Close() }, nil
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, nil, errf("buffering zip contents: %w", err)
+	}
+	return bytesReaderAt(data), int64(len(data)), func() {}, nil
+}
+
+type bytesReaderAt []byte
+
+func (b bytesReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// zipDir is a directory within a zip archive, real or implicit.
+type zipDir struct {
+	fsnode.ParentReadOnly
+	fsnode.FileInfo
+	index *zipIndex
+	dir   string
+}
+
+var (
+	_ fsnode.Parent    = (*zipDir)(nil)
+	_ fsnode.Cacheable = (*zipDir)(nil)
+)
+
+func (d *zipDir) FSNodeT() {}
+
+func (d *zipDir) Child(ctx context.Context, name string) (fsnode.T, error) {
+	p := path.Join(d.dir, name)
+	if f, ok := d.index.byPath[p]; ok {
+		return zipFileToNode(d.index, p, f), nil
+	}
+	if _, ok := d.index.under[p]; ok {
+		return &zipDir{FileInfo: fsnode.NewDirInfo(name).WithModePerm(0755 | 0111), index: d.index, dir: p}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (d *zipDir) Children() fsnode.Iterator {
+	paths := d.index.under[d.dir]
+	nodes := make([]fsnode.T, 0, len(paths))
+	for _, p := range paths {
+		if f, ok := d.index.byPath[p]; ok {
+			nodes = append(nodes, zipFileToNode(d.index, p, f))
+		} else {
+			nodes = append(nodes, &zipDir{
+				FileInfo: fsnode.NewDirInfo(path.Base(p)).WithModePerm(0755 | 0111),
+				index:    d.index,
+				dir:      p,
+			})
+		}
+	}
+	return fsnode.NewIterator(nodes...)
+}
+
+func zipFileToNode(index *zipIndex, p string, f *zip.File) fsnode.T {
+	name := path.Base(p)
+	mode := f.Mode()
+	if mode.IsDir() {
+		return &zipDir{FileInfo: fsnode.NewDirInfo(name).WithModePerm(0755 | 0111), index: index, dir: p}
+	}
+	if mode&os.ModeSymlink != 0 {
+		target, err := readZipFile(f)
+		if err != nil {
+			target = []byte{}
+		}
+		return fsnode.ConstLeaf(fsnode.NewSymlinkInfo(name).WithModTime(f.Modified), target)
+	}
+	info := fsnode.NewRegInfo(name).
+		WithModTime(f.Modified).
+		WithModePerm(mode.Perm()).
+		WithSize(int64(f.UncompressedSize64))
+	return leafFromOpener(info, func(ctx context.Context) (io.ReadCloser, error) {
+		return f.Open()
+	})
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
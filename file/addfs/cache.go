@@ -0,0 +1,172 @@
+package addfs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/file/fsnode"
+)
+
+// CacheKey identifies one PerNodeFunc.Apply call: a particular func (by its position among the
+// funcs passed to ApplyPerNodeFuncsWithOptions) applied to the node at a particular path, as of a
+// particular ModTime. Including ModTime means a cache entry is naturally invalidated when the
+// underlying node changes, without Cache having to know anything about what changed.
+type CacheKey struct {
+	FuncIndex int
+	NodePath  string
+	ModTime   time.Time
+}
+
+// Cache memoizes the results of PerNodeFunc.Apply calls. Implementations must be safe for
+// concurrent use, and must singleflight concurrent GetOrCompute calls for the same key: if
+// compute is already running for a key, later callers wait on that call rather than starting
+// their own.
+type Cache interface {
+	// GetOrCompute returns the cached adds for key if a still-valid one is cached; otherwise it
+	// calls compute at most once (even under concurrent calls for the same key) and, if the
+	// returned ttl is positive, caches the result for that long.
+	//
+	// compute decides ttl itself (typically with cacheTTL's min-of-fsnode.CacheableFor logic)
+	// since that depends on its own result, which Cache can't know in advance.
+	//
+	// If ctx is canceled while waiting on another caller's in-flight compute, GetOrCompute
+	// returns ctx.Err() immediately; the in-flight compute's own context is only canceled once
+	// every caller waiting on it has done the same, so one impatient caller doesn't cut off a
+	// result others still want.
+	GetOrCompute(ctx context.Context, key CacheKey, compute func(context.Context) (adds []fsnode.T, ttl time.Duration, err error)) ([]fsnode.T, error)
+}
+
+// NewMemCache returns a Cache that holds entries in memory, for the lifetime of the returned
+// value.
+func NewMemCache() Cache {
+	return &memCache{
+		entries: make(map[CacheKey]memCacheEntry),
+		calls:   make(map[CacheKey]*memCacheCall),
+	}
+}
+
+type memCacheEntry struct {
+	adds []fsnode.T
+	// forever is true if the entry was cached with a negative ("cache forever") TTL and never
+	// expires. validUntil is meaningless when forever is true.
+	forever    bool
+	validUntil time.Time
+}
+
+// memCacheCall tracks a single in-flight compute, shared by every caller currently waiting on it.
+type memCacheCall struct {
+	done chan struct{}
+	adds []fsnode.T
+	err  error
+
+	mu      sync.Mutex
+	waiters int
+	cancel  context.CancelFunc
+}
+
+type memCache struct {
+	mu      sync.Mutex
+	entries map[CacheKey]memCacheEntry
+	calls   map[CacheKey]*memCacheCall
+}
+
+func (c *memCache) GetOrCompute(
+	ctx context.Context, key CacheKey, compute func(context.Context) ([]fsnode.T, time.Duration, error),
+) ([]fsnode.T, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && (e.forever || time.Now().Before(e.validUntil)) {
+		c.mu.Unlock()
+		return e.adds, nil
+	}
+	if call, ok := c.calls[key]; ok {
+		call.mu.Lock()
+		// A call whose waiters have all given up has had its context canceled; don't join it.
+		joined := call.waiters > 0
+		if joined {
+			call.waiters++
+		}
+		call.mu.Unlock()
+		if joined {
+			c.mu.Unlock()
+			return c.wait(ctx, call)
+		}
+	}
+	callCtx, cancel := context.WithCancel(context.Background())
+	call := &memCacheCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	go func() {
+		var ttl time.Duration
+		call.adds, ttl, call.err = compute(callCtx)
+		close(call.done)
+		c.mu.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		switch {
+		case call.err != nil:
+		case ttl < 0: // fsnode.Cacheable.CacheableFor: negative means cache forever.
+			c.entries[key] = memCacheEntry{adds: call.adds, forever: true}
+		case ttl > 0:
+			c.entries[key] = memCacheEntry{adds: call.adds, validUntil: time.Now().Add(ttl)}
+		}
+		c.mu.Unlock()
+	}()
+	return c.wait(ctx, call)
+}
+
+func (c *memCache) wait(ctx context.Context, call *memCacheCall) ([]fsnode.T, error) {
+	select {
+	case <-call.done:
+		return call.adds, call.err
+	case <-ctx.Done():
+		call.mu.Lock()
+		call.waiters--
+		last := call.waiters == 0
+		call.mu.Unlock()
+		if last {
+			call.cancel()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// cacheTTL derives the duration a cached Apply result may be reused for: the most restrictive of
+// what the child node and every add claim via fsnode.CacheableFor, further capped by staleAfter if
+// staleAfter is positive. This lets PerNodeFuncOptions.StaleAfter impose a tighter bound than an
+// upstream node's own (possibly too-optimistic) CacheableFor.
+//
+// "Most restrictive" isn't a plain numeric min: per fsnode.Cacheable's CacheableFor contract, any
+// negative duration (not just fsnode.CacheForever) means "cache forever" and must lose to every
+// finite duration (including 0, "don't cache"), not win as if it were the smallest value.
+func cacheTTL(child fsnode.T, adds []fsnode.T, staleAfter time.Duration) time.Duration {
+	ttl := fsnode.CacheableFor(child)
+	for _, add := range adds {
+		ttl = minTTL(ttl, fsnode.CacheableFor(add))
+	}
+	if staleAfter > 0 {
+		ttl = minTTL(ttl, staleAfter)
+	}
+	return ttl
+}
+
+// minTTL returns the more restrictive (shorter-lived) of two CacheableFor-style durations: 0
+// ("don't cache") beats everything, a finite positive duration beats any negative ("forever")
+// duration, and between two finite durations the smaller wins.
+func minTTL(a, b time.Duration) time.Duration {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if a < 0 {
+		return b
+	}
+	if b < 0 {
+		return a
+	}
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,140 @@
+package addfs
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grailbio/base/file/fsnode"
+)
+
+func TestMemCache_Singleflight(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemCache()
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	compute := func(context.Context) ([]fsnode.T, time.Duration, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-release
+		}
+		return nil, time.Minute, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.GetOrCompute(ctx, CacheKey{NodePath: "a"}, compute); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	<-started
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("got %d compute calls, want 1", got)
+	}
+}
+
+func TestMemCache_WaiterCancellationDoesNotCutOffOthers(t *testing.T) {
+	c := NewMemCache()
+	computeCanceled := make(chan struct{})
+	computeDone := make(chan struct{})
+	compute := func(ctx context.Context) ([]fsnode.T, time.Duration, error) {
+		select {
+		case <-ctx.Done():
+			close(computeCanceled)
+			return nil, 0, ctx.Err()
+		case <-computeDone:
+			return nil, 0, nil
+		}
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	var err1 error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err1 = c.GetOrCompute(ctx1, CacheKey{NodePath: "a"}, compute)
+	}()
+
+	// Give the first waiter a chance to register before the second joins it.
+	time.Sleep(10 * time.Millisecond)
+
+	ctx2 := context.Background()
+	var wg2 sync.WaitGroup
+	wg2.Add(1)
+	go func() {
+		defer wg2.Done()
+		if _, err := c.GetOrCompute(ctx2, CacheKey{NodePath: "a"}, compute); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Wait for the second waiter to join the in-flight call, so that canceling the first isn't
+	// the last cancellation.
+	mc := c.(*memCache)
+	for joined := false; !joined; {
+		mc.mu.Lock()
+		if call, ok := mc.calls[CacheKey{NodePath: "a"}]; ok {
+			call.mu.Lock()
+			joined = call.waiters == 2
+			call.mu.Unlock()
+		}
+		mc.mu.Unlock()
+		if !joined {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	cancel1()
+	wg.Wait()
+	if err1 != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err1)
+	}
+
+	select {
+	case <-computeCanceled:
+		t.Fatal("compute's context was canceled while another waiter was still waiting")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(computeDone)
+	wg2.Wait()
+}
+
+func TestMemCache_TTLExpiry(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemCache()
+	var calls int32
+	compute := func(context.Context) ([]fsnode.T, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, 10 * time.Millisecond, nil
+	}
+
+	if _, err := c.GetOrCompute(ctx, CacheKey{NodePath: "a"}, compute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetOrCompute(ctx, CacheKey{NodePath: "a"}, compute); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("got %d compute calls before expiry, want 1", got)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, err := c.GetOrCompute(ctx, CacheKey{NodePath: "a"}, compute); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("got %d compute calls after expiry, want 2", got)
+	}
+}
@@ -0,0 +1,162 @@
+package addfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/grailbio/base/file/fsnode"
+)
+
+// ConflictPolicy decides what to add when multiple sources produce nodes under the same name:
+// either several PerNodeFuncs adding the same name under one .../, or (for the top-level ".../"
+// itself) an input tree that happens to already have a child literally named "...".
+type ConflictPolicy interface {
+	// Resolve is called once per colliding name, with every node produced under it, in the order
+	// their sources ran. It returns the node(s) to actually add, keyed by final name — typically
+	// {name: some single node}, but e.g. ConflictMerge may expand a single name into several
+	// (name, name.1, name.2, ...) if it can't merge everything into one.
+	Resolve(ctx context.Context, name string, nodes []fsnode.T) (map[string]fsnode.T, error)
+}
+
+// ConflictPolicyFunc adapts a plain function to a ConflictPolicy.
+type ConflictPolicyFunc func(ctx context.Context, name string, nodes []fsnode.T) (map[string]fsnode.T, error)
+
+func (f ConflictPolicyFunc) Resolve(ctx context.Context, name string, nodes []fsnode.T) (map[string]fsnode.T, error) {
+	return f(ctx, name, nodes)
+}
+
+// ConflictCustom adapts a pairwise resolver — given the node chosen so far and the next
+// colliding one, return the node to keep — to a ConflictPolicy, by left-folding it over every
+// colliding node in order.
+func ConflictCustom(fn func(name string, existing, incoming fsnode.T) (fsnode.T, error)) ConflictPolicy {
+	return ConflictPolicyFunc(func(_ context.Context, name string, nodes []fsnode.T) (map[string]fsnode.T, error) {
+		existing := nodes[0]
+		for _, incoming := range nodes[1:] {
+			var err error
+			existing, err = fn(name, existing, incoming)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return map[string]fsnode.T{name: existing}, nil
+	})
+}
+
+// ConflictLastWins keeps only the last-produced node for a name, discarding the rest. This is
+// addfs's original behavior, and the default when no ConflictPolicy is configured.
+var ConflictLastWins ConflictPolicy = ConflictPolicyFunc(
+	func(_ context.Context, name string, nodes []fsnode.T) (map[string]fsnode.T, error) {
+		return map[string]fsnode.T{name: nodes[len(nodes)-1]}, nil
+	},
+)
+
+// ConflictFirstWins keeps only the first-produced node for a name, discarding the rest.
+var ConflictFirstWins ConflictPolicy = ConflictPolicyFunc(
+	func(_ context.Context, name string, nodes []fsnode.T) (map[string]fsnode.T, error) {
+		return map[string]fsnode.T{name: nodes[0]}, nil
+	},
+)
+
+// ConflictError rejects any collision, surfacing an error from whatever Child or Children call
+// triggered it.
+var ConflictError ConflictPolicy = ConflictPolicyFunc(
+	func(_ context.Context, name string, nodes []fsnode.T) (map[string]fsnode.T, error) {
+		return nil, fmt.Errorf("addfs: %d-way conflict for added name: %s", len(nodes), name)
+	},
+)
+
+// ConflictMerge recursively merges colliding fsnode.Parents (the union of their children,
+// resolving any sub-collisions with ConflictMerge as well) and, for colliding leaves it has no way
+// to merge, keeps all of them by suffixing every one past the first with ".1", ".2", etc. (the
+// first keeps the bare name unless a merged Parent already claimed it, in which case numbering
+// starts there too).
+var ConflictMerge ConflictPolicy = conflictMergePolicy{}
+
+type conflictMergePolicy struct{}
+
+func (conflictMergePolicy) Resolve(ctx context.Context, name string, nodes []fsnode.T) (map[string]fsnode.T, error) {
+	var parents []fsnode.Parent
+	var leaves []fsnode.T
+	for _, n := range nodes {
+		if p, ok := n.(fsnode.Parent); ok {
+			parents = append(parents, p)
+		} else {
+			leaves = append(leaves, n)
+		}
+	}
+	out := make(map[string]fsnode.T, len(leaves)+1)
+	if len(parents) > 0 {
+		merged := parents[0]
+		for _, p := range parents[1:] {
+			merged = mergeParents(merged, p)
+		}
+		out[name] = merged
+	} else if len(leaves) > 0 {
+		out[name] = leaves[0]
+		leaves = leaves[1:]
+	}
+	for i, leaf := range leaves {
+		out[fmt.Sprintf("%s.%d", name, i+1)] = leaf
+	}
+	return out, nil
+}
+
+// mergeByName groups nodes by name and resolves any group with more than one entry via policy,
+// leaving unambiguous (single-entry) groups untouched.
+func mergeByName(ctx context.Context, policy ConflictPolicy, groups map[string][]fsnode.T) (map[string]fsnode.T, error) {
+	if policy == nil {
+		policy = ConflictLastWins
+	}
+	out := make(map[string]fsnode.T, len(groups))
+	for name, nodes := range groups {
+		if len(nodes) == 1 {
+			out[name] = nodes[0]
+			continue
+		}
+		resolved, err := policy.Resolve(ctx, name, nodes)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range resolved {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+// mergeParents returns a Parent presenting the union of a's and b's children, recursing into any
+// names both have via ConflictMerge. Unlike the rest of this package, it lists both a and b in
+// full on every Child or Children call rather than streaming: merge conflicts are assumed to be the rare,
+// not-performance-critical path, so we trade laziness for simplicity here.
+func mergeParents(a, b fsnode.Parent) fsnode.Parent {
+	return fsnode.NewParent(
+		fsnode.CopyFileInfo(a.Info()),
+		fsnode.FuncChildren(func(ctx context.Context) ([]fsnode.T, error) {
+			groups := make(map[string][]fsnode.T)
+			for _, p := range [...]fsnode.Parent{a, b} {
+				it := p.Children()
+				for {
+					child, err := it.Next(ctx)
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						return nil, err
+					}
+					name := child.Info().Name()
+					groups[name] = append(groups[name], child)
+				}
+			}
+			resolved, err := mergeByName(ctx, ConflictMerge, groups)
+			if err != nil {
+				return nil, err
+			}
+			out := make([]fsnode.T, 0, len(resolved))
+			for name, n := range resolved {
+				out = append(out, renameNode(n, name))
+			}
+			return out, nil
+		}),
+	)
+}
@@ -0,0 +1,110 @@
+package addfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/grailbio/base/file/fsnode"
+)
+
+func TestMergeParents_UnionOfChildren(t *testing.T) {
+	ctx := context.Background()
+	a := dirNode{
+		FileInfo: fsnode.NewDirInfo("merged"),
+		children: map[string]fsnode.T{"x": newMemLeaf("x", []byte("x"))},
+	}
+	b := dirNode{
+		FileInfo: fsnode.NewDirInfo("merged"),
+		children: map[string]fsnode.T{"y": newMemLeaf("y", []byte("y"))},
+	}
+	merged := mergeParents(a, b)
+	if _, err := merged.Child(ctx, "x"); err != nil {
+		t.Errorf("x: %v", err)
+	}
+	if _, err := merged.Child(ctx, "y"); err != nil {
+		t.Errorf("y: %v", err)
+	}
+	if _, err := merged.Child(ctx, "z"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("z: got %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestMergeParents_RecursesIntoSharedNames(t *testing.T) {
+	ctx := context.Background()
+	a := dirNode{
+		FileInfo: fsnode.NewDirInfo("merged"),
+		children: map[string]fsnode.T{
+			"sub": dirNode{
+				FileInfo: fsnode.NewDirInfo("sub"),
+				children: map[string]fsnode.T{"x": newMemLeaf("x", []byte("x"))},
+			},
+		},
+	}
+	b := dirNode{
+		FileInfo: fsnode.NewDirInfo("merged"),
+		children: map[string]fsnode.T{
+			"sub": dirNode{
+				FileInfo: fsnode.NewDirInfo("sub"),
+				children: map[string]fsnode.T{"y": newMemLeaf("y", []byte("y"))},
+			},
+		},
+	}
+	merged := mergeParents(a, b)
+	sub, err := merged.Child(ctx, "sub")
+	if err != nil {
+		t.Fatalf("sub: %v", err)
+	}
+	subParent, ok := sub.(fsnode.Parent)
+	if !ok {
+		t.Fatalf("sub: got %T, want fsnode.Parent", sub)
+	}
+	if _, err := subParent.Child(ctx, "x"); err != nil {
+		t.Errorf("sub/x: %v", err)
+	}
+	if _, err := subParent.Child(ctx, "y"); err != nil {
+		t.Errorf("sub/y: %v", err)
+	}
+}
+
+func TestConflictMerge_ParentLeafMixedCollision(t *testing.T) {
+	ctx := context.Background()
+	parent := dirNode{FileInfo: fsnode.NewDirInfo("name")}
+	leaf := newMemLeaf("name", []byte("leaf"))
+
+	resolved, err := ConflictMerge.Resolve(ctx, "name", []fsnode.T{parent, leaf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(resolved), 2; got != want {
+		t.Fatalf("got %d results, want %d: %v", got, want, resolved)
+	}
+	if _, ok := resolved["name"].(fsnode.Parent); !ok {
+		t.Errorf("resolved[%q]: got %T, want the fsnode.Parent", "name", resolved["name"])
+	}
+	if resolved["name.1"] != leaf {
+		t.Errorf("resolved[%q] = %v, want the leaf", "name.1", resolved["name.1"])
+	}
+}
+
+func TestConflictMerge_ThreeWayLeafFold(t *testing.T) {
+	ctx := context.Background()
+	leaves := []fsnode.T{
+		newMemLeaf("name", []byte("1")),
+		newMemLeaf("name", []byte("2")),
+		newMemLeaf("name", []byte("3")),
+	}
+	resolved, err := ConflictMerge.Resolve(ctx, "name", leaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"name", "name.1", "name.2"} {
+		if _, ok := resolved[name]; !ok {
+			t.Errorf("missing %q in resolved: %v", name, resolved)
+		}
+	}
+	if got, want := len(resolved), 3; got != want {
+		t.Errorf("got %d results, want %d: %v", got, want, resolved)
+	}
+}
@@ -0,0 +1,128 @@
+package addfs
+
+import (
+	"context"
+	"io"
+	"path"
+	"time"
+
+	"github.com/grailbio/base/file/fsnode"
+)
+
+// lookupCacheFuncIndex is the CacheKey.FuncIndex used for lookupPerNodeFunc's own resolve cache.
+// It's negative so it can never collide with a real index into ApplyPerNodeFuncsWithOptions's fns,
+// which are numbered starting at 0, even if the same Cache is shared between the two.
+const lookupCacheFuncIndex = -1
+
+// LookupOption configures a PerNodeFunc created by NewLookupPerNodeFunc.
+type LookupOption func(*lookupPerNodeFunc)
+
+// WithLookupChildren gives the lookup view a Children() enumeration: list returns every id
+// currently known, and each is resolved (and cached, if WithLookupCache is set) the same way a
+// direct Child(ctx, id) call would be. Without this option, Children() is empty: ids must be
+// looked up by name, matching the Arvados by_id pattern this is based on.
+func WithLookupChildren(list func(ctx context.Context) ([]string, error)) LookupOption {
+	return func(f *lookupPerNodeFunc) { f.list = list }
+}
+
+// WithLookupCache memoizes resolve calls in cache, keyed by id, so that repeatedly navigating to
+// the same id doesn't repeatedly pay resolve's cost. staleAfter caps how long an entry may be
+// reused, as with PerNodeFuncOptions.StaleAfter; zero means no extra cap beyond the resolved
+// node's own fsnode.CacheableFor.
+func WithLookupCache(cache Cache, staleAfter time.Duration) LookupOption {
+	return func(f *lookupPerNodeFunc) {
+		f.cache = cache
+		f.staleAfter = staleAfter
+	}
+}
+
+// NewLookupPerNodeFunc returns a PerNodeFunc that, for any node it's applied to, adds a child
+// named name under .../ that is itself a fsnode.Parent resolving ids lazily: navigating to
+// .../<node>/name/<id> calls resolve(ctx, id) on demand, rather than requiring every id to be
+// enumerated up front. This lets callers graft content-addressed views (S3 keys, blob hashes,
+// remote collection UUIDs, etc.) into any point in the tree cheaply. Resolved subtrees are
+// themselves Parents, so they compose with the surrounding recursion: other PerNodeFuncs apply to
+// them too.
+func NewLookupPerNodeFunc(name string, resolve func(ctx context.Context, id string) (fsnode.T, error), opts ...LookupOption) PerNodeFunc {
+	f := &lookupPerNodeFunc{name: name, resolve: resolve}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+type lookupPerNodeFunc struct {
+	name       string
+	resolve    func(context.Context, string) (fsnode.T, error)
+	list       func(context.Context) ([]string, error)
+	cache      Cache
+	staleAfter time.Duration
+}
+
+func (f *lookupPerNodeFunc) Apply(context.Context, fsnode.T) ([]fsnode.T, error) {
+	return []fsnode.T{&lookupDir{FileInfo: fsnode.NewDirInfo(f.name), f: f}}, nil
+}
+
+func (f *lookupPerNodeFunc) resolveCached(ctx context.Context, id string) (fsnode.T, error) {
+	if f.cache == nil {
+		return f.resolve(ctx, id)
+	}
+	key := CacheKey{FuncIndex: lookupCacheFuncIndex, NodePath: path.Join(f.name, id)}
+	nodes, err := f.cache.GetOrCompute(ctx, key, func(ctx context.Context) ([]fsnode.T, time.Duration, error) {
+		node, err := f.resolve(ctx, id)
+		if err != nil {
+			return nil, 0, err
+		}
+		return []fsnode.T{node}, cacheTTL(node, nil, f.staleAfter), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodes[0], nil
+}
+
+// lookupDir is the .../<node>/name/ Parent: a lazy, identifier-indexed view.
+type lookupDir struct {
+	fsnode.ParentReadOnly
+	fsnode.FileInfo
+	f *lookupPerNodeFunc
+}
+
+func (d *lookupDir) FSNodeT() {}
+func (d *lookupDir) Child(ctx context.Context, id string) (fsnode.T, error) {
+	return d.f.resolveCached(ctx, id)
+}
+func (d *lookupDir) Children() fsnode.Iterator {
+	if d.f.list == nil {
+		return fsnode.NewIterator()
+	}
+	return &lookupChildIterator{dir: d}
+}
+
+// lookupChildIterator lists ids on first Next, then resolves (and caches, per the dir's
+// lookupPerNodeFunc) each one in turn.
+type lookupChildIterator struct {
+	dir    *lookupDir
+	listed bool
+	ids    []string
+	idx    int
+}
+
+func (it *lookupChildIterator) Next(ctx context.Context) (fsnode.T, error) {
+	if !it.listed {
+		ids, err := it.dir.f.list(ctx)
+		if err != nil {
+			return nil, err
+		}
+		it.ids = ids
+		it.listed = true
+	}
+	if it.idx >= len(it.ids) {
+		return nil, io.EOF
+	}
+	id := it.ids[it.idx]
+	it.idx++
+	return it.dir.f.resolveCached(ctx, id)
+}
+
+func (it *lookupChildIterator) Close(context.Context) error { return nil }
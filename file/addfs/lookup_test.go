@@ -0,0 +1,123 @@
+package addfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/base/file/fsnode"
+)
+
+// memParent is a minimal fsnode.Parent with no children, for testing.
+type memParent struct {
+	fsnode.ParentReadOnly
+	fsnode.FileInfo
+}
+
+func (p memParent) FSNodeT() {}
+func (p memParent) Child(context.Context, string) (fsnode.T, error) {
+	return nil, fs.ErrNotExist
+}
+func (p memParent) Children() fsnode.Iterator { return fsnode.NewIterator() }
+
+func TestLookupPerNodeFunc(t *testing.T) {
+	ctx := context.Background()
+	resolve := func(_ context.Context, id string) (fsnode.T, error) {
+		return memParent{FileInfo: fsnode.NewDirInfo(id)}, nil
+	}
+	fn := NewLookupPerNodeFunc("by_id", resolve)
+
+	adds, err := fn.Apply(ctx, memParent{FileInfo: fsnode.NewDirInfo("root")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adds) != 1 {
+		t.Fatalf("got %d adds, want 1", len(adds))
+	}
+	view := adds[0].(fsnode.Parent)
+	if got, want := view.Info().Name(), "by_id"; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+	child, err := view.Child(ctx, "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := child.Info().Name(), "abc123"; got != want {
+		t.Errorf("got resolved name %q, want %q", got, want)
+	}
+}
+
+func TestLookupPerNodeFunc_DedupesViaCache(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	calls := 0
+	resolve := func(_ context.Context, id string) (fsnode.T, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return memParent{FileInfo: fsnode.NewDirInfo(id).WithCacheableFor(time.Minute)}, nil
+	}
+	cache := NewMemCache()
+	fn := NewLookupPerNodeFunc("by_id", resolve, WithLookupCache(cache, 0))
+
+	adds, err := fn.Apply(ctx, memParent{FileInfo: fsnode.NewDirInfo("root")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := adds[0].(fsnode.Parent)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := view.Child(ctx, "abc123"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := view.Child(ctx, "abc123"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("got %d resolve calls, want 1 (expected dedup via cache)", calls)
+	}
+}
+
+func TestLookupPerNodeFunc_Children(t *testing.T) {
+	ctx := context.Background()
+	ids := []string{"a", "b", "c"}
+	resolve := func(_ context.Context, id string) (fsnode.T, error) {
+		return memParent{FileInfo: fsnode.NewDirInfo(id)}, nil
+	}
+	list := func(context.Context) ([]string, error) { return ids, nil }
+	fn := NewLookupPerNodeFunc("by_id", resolve, WithLookupChildren(list))
+
+	adds, err := fn.Apply(ctx, memParent{FileInfo: fsnode.NewDirInfo("root")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := adds[0].(fsnode.Parent)
+	it := view.Children()
+	var got []string
+	for {
+		n, err := it.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, n.Info().Name())
+	}
+	if len(got) != len(ids) {
+		t.Fatalf("got %d children, want %d", len(got), len(ids))
+	}
+}
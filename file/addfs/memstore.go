@@ -0,0 +1,161 @@
+package addfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/file/fsnode"
+)
+
+// NewMemWriteStore returns a WriteStore that holds everything written through it in memory, for
+// the lifetime of the returned value. It's a reasonable default for tests and short-lived
+// overlays; a longer-lived overlay will likely want a WriteStore backed by local disk or a blob
+// store instead.
+func NewMemWriteStore() WriteStore {
+	return &memWriteStore{
+		dirs:  map[string]time.Time{"": {}},
+		files: make(map[string][]byte),
+		mtime: make(map[string]time.Time),
+	}
+}
+
+type memWriteStore struct {
+	mu    sync.Mutex
+	dirs  map[string]time.Time // dir path -> creation time
+	files map[string][]byte
+	mtime map[string]time.Time
+}
+
+func memParentOf(p string) string {
+	dir := path.Dir(p)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// mkdirLocked creates dir and every ancestor of it that doesn't already exist. Callers must hold
+// s.mu.
+func (s *memWriteStore) mkdirLocked(dir string) {
+	for dir != "" && s.dirs[dir].IsZero() {
+		delete(s.files, dir)
+		s.dirs[dir] = time.Now()
+		dir = memParentOf(dir)
+	}
+}
+
+func (s *memWriteStore) Create(ctx context.Context, p string) (io.WriteCloser, error) {
+	s.mu.Lock()
+	s.mkdirLocked(memParentOf(p))
+	s.mu.Unlock()
+	return &memWriteCloser{store: s, path: p}, nil
+}
+
+// memWriteCloser buffers a Create'd file's content, committing it to the store on Close (matching
+// how a local-disk-backed WriteStore would only make the write visible once the file is closed).
+type memWriteCloser struct {
+	store *memWriteStore
+	path  string
+	buf   bytes.Buffer
+}
+
+func (w *memWriteCloser) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *memWriteCloser) Close() error {
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	w.store.files[w.path] = append([]byte(nil), w.buf.Bytes()...)
+	delete(w.store.dirs, w.path)
+	w.store.mtime[w.path] = time.Now()
+	return nil
+}
+
+func (s *memWriteStore) Mkdir(ctx context.Context, p string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mkdirLocked(p)
+	return nil
+}
+
+func (s *memWriteStore) Open(ctx context.Context, p string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[p]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memWriteStore) Stat(ctx context.Context, p string) (fsnode.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.dirs[p]; ok {
+		return fsnode.NewDirInfo(path.Base(p)).WithModTime(t), nil
+	}
+	if data, ok := s.files[p]; ok {
+		return fsnode.NewRegInfo(path.Base(p)).WithModTime(s.mtime[p]).WithSize(int64(len(data))), nil
+	}
+	return fsnode.FileInfo{}, fs.ErrNotExist
+}
+
+func (s *memWriteStore) List(ctx context.Context, dir string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	var names []string
+	add := func(p string) {
+		if p == "" || memParentOf(p) != dir {
+			return
+		}
+		name := path.Base(p)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for p := range s.dirs {
+		add(p)
+	}
+	for p := range s.files {
+		add(p)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *memWriteStore) Remove(ctx context.Context, p string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, isDir := s.dirs[p]
+	_, isFile := s.files[p]
+	if !isDir && !isFile {
+		return fs.ErrNotExist
+	}
+	if !isDir {
+		delete(s.files, p)
+		delete(s.mtime, p)
+		return nil
+	}
+	prefix := p + "/"
+	for d := range s.dirs {
+		if d == p || strings.HasPrefix(d, prefix) {
+			delete(s.dirs, d)
+			delete(s.mtime, d)
+		}
+	}
+	for f := range s.files {
+		if strings.HasPrefix(f, prefix) {
+			delete(s.files, f)
+			delete(s.mtime, f)
+		}
+	}
+	return nil
+}
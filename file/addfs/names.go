@@ -0,0 +1,94 @@
+package addfs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grailbio/base/file/fsnode"
+	"github.com/grailbio/base/ioctx/fsctx"
+)
+
+// NameSubstituter makes an arbitrary name (for example, one a PerNodeFunc derived from an archive
+// entry path or a remote key) safe to use as a single added directory entry.
+type NameSubstituter interface {
+	// Substitute returns name as a safe child-entry name, or an error if name can't be made safe
+	// at all (e.g. it's empty, or contains a NUL byte).
+	Substitute(name string) (string, error)
+}
+
+// NameSubstituterFunc adapts a plain function to a NameSubstituter.
+type NameSubstituterFunc func(name string) (string, error)
+
+func (f NameSubstituterFunc) Substitute(name string) (string, error) { return f(name) }
+
+// defaultNameSubstituter is used when PerNodeFuncOptions.NameSubstituter is unset.
+var defaultNameSubstituter = NewPathSeparatorSubstituter("_")
+
+// NewPathSeparatorSubstituter returns a NameSubstituter that replaces every "/" (and "\\", for
+// names that came from Windows-style paths) in name with sep, and folds ".", "..", and addfs's
+// own "..." sentinel to a form ending in sep so they can't be mistaken for their special
+// meanings. It rejects the empty name and any name containing a NUL byte, neither of which sep
+// can fix. Substitution isn't guaranteed to be collision-free — two different names can map to
+// the same result — but any collision it does introduce is handed to the configured
+// ConflictPolicy (with the default, ConflictLastWins, only the last colliding node is kept).
+func NewPathSeparatorSubstituter(sep string) NameSubstituter {
+	return NameSubstituterFunc(func(name string) (string, error) {
+		if name == "" {
+			return "", fmt.Errorf("addfs: refusing to add an empty name")
+		}
+		if strings.ContainsRune(name, 0) {
+			return "", fmt.Errorf("addfs: refusing to add name containing a NUL byte: %q", name)
+		}
+		substituted := strings.NewReplacer("/", sep, "\\", sep).Replace(name)
+		switch substituted {
+		case ".", "..", addsDirName:
+			substituted += sep
+		}
+		return substituted, nil
+	})
+}
+
+// renameNode returns node with its reported name changed to name, preserving whichever of
+// fsnode.Parent or fsnode.Leaf it implements (a symlink is just a fsnode.Leaf whose FileInfo was
+// built with fsnode.NewSymlinkInfo, so it's covered by the fsnode.Leaf case). If node's name is
+// already name, it is returned unchanged.
+func renameNode(node fsnode.T, name string) fsnode.T {
+	if node.Info().Name() == name {
+		return node
+	}
+	info := fsnode.CopyFileInfo(node.Info()).WithName(name)
+	switch n := node.(type) {
+	case fsnode.Parent:
+		return &renamedParent{FileInfo: info, inner: n}
+	case fsnode.Leaf:
+		return &renamedLeaf{FileInfo: info, inner: n}
+	default:
+		return node
+	}
+}
+
+type renamedParent struct {
+	fsnode.FileInfo
+	fsnode.ParentReadOnly
+	inner fsnode.Parent
+}
+
+func (r *renamedParent) FSNodeT() {}
+func (r *renamedParent) CacheableFor() time.Duration { return fsnode.CacheableFor(r.inner) }
+func (r *renamedParent) Child(ctx context.Context, name string) (fsnode.T, error) {
+	return r.inner.Child(ctx, name)
+}
+func (r *renamedParent) Children() fsnode.Iterator { return r.inner.Children() }
+
+type renamedLeaf struct {
+	fsnode.FileInfo
+	inner fsnode.Leaf
+}
+
+func (r *renamedLeaf) FSNodeT() {}
+func (r *renamedLeaf) CacheableFor() time.Duration { return fsnode.CacheableFor(r.inner) }
+func (r *renamedLeaf) OpenFile(ctx context.Context, flag int) (fsctx.File, error) {
+	return r.inner.OpenFile(ctx, flag)
+}
@@ -0,0 +1,51 @@
+package addfs
+
+import (
+	"testing"
+
+	"github.com/grailbio/base/file/fsnode"
+)
+
+func TestNewPathSeparatorSubstituter(t *testing.T) {
+	sub := NewPathSeparatorSubstituter("_")
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"plain", "plain"},
+		{"a/b/c", "a_b_c"},
+		{"a\\b", "a_b"},
+		{".", "._"},
+		{"..", ".._"},
+		{addsDirName, addsDirName + "_"},
+	} {
+		got, err := sub.Substitute(tc.name)
+		if err != nil {
+			t.Fatalf("Substitute(%q): %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("Substitute(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNewPathSeparatorSubstituter_RejectsUnsafeNames(t *testing.T) {
+	sub := NewPathSeparatorSubstituter("_")
+	for _, name := range []string{"", "a\x00b"} {
+		if _, err := sub.Substitute(name); err == nil {
+			t.Errorf("Substitute(%q): expected error, got nil", name)
+		}
+	}
+}
+
+func TestNewPathSeparatorSubstituter_RenamedNodeReportsSubstitutedName(t *testing.T) {
+	sub := NewPathSeparatorSubstituter("_")
+	original := "a/b/c"
+	substituted, err := sub.Substitute(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := renameNode(memParent{FileInfo: fsnode.NewDirInfo(original)}, substituted)
+	if got := node.Info().Name(); got != substituted {
+		t.Errorf("got name %q, want %q", got, substituted)
+	}
+}
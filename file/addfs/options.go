@@ -0,0 +1,56 @@
+package addfs
+
+import (
+	"context"
+	"time"
+)
+
+// PerNodeFuncOptions configures how ApplyPerNodeFuncsWithOptions invokes PerNodeFuncs.
+type PerNodeFuncOptions struct {
+	// MaxConcurrency caps the number of PerNodeFunc.Apply calls that may run concurrently across
+	// a single ApplyPerNodeFuncsWithOptions tree (including however many children the caller ends
+	// up listing or looking up concurrently). Zero means unlimited.
+	MaxConcurrency int
+	// Cache, if set, memoizes Apply results. See Cache and CacheKey.
+	Cache Cache
+	// StaleAfter caps how long a Cache entry may be reused, regardless of how long the underlying
+	// nodes claim to be cacheable for (fsnode.CacheableFor). Zero means no extra cap.
+	StaleAfter time.Duration
+	// ConflictPolicy resolves what to do when multiple PerNodeFuncs add the same name under one
+	// .../, or when the input tree already has a child literally named "...". Nil means
+	// ConflictLastWins, matching ApplyPerNodeFuncs's historical behavior.
+	ConflictPolicy ConflictPolicy
+	// NameSubstituter makes names added by PerNodeFuncs safe to use as a single directory entry
+	// (for example, replacing any "/" a func derived from an archive entry path or remote key).
+	// Nil means NewPathSeparatorSubstituter("_").
+	NameSubstituter NameSubstituter
+}
+
+// semaphore bounds concurrency; a nil semaphore (MaxConcurrency == 0) imposes no limit.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	if s == nil {
+		return
+	}
+	<-s
+}
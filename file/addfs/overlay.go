@@ -0,0 +1,564 @@
+package addfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/base/file/fsnode"
+	"github.com/grailbio/base/ioctx"
+	"github.com/grailbio/base/ioctx/fsctx"
+)
+
+// WriteStore is scratch storage for the writes made to a WritableApplyPerNodeFuncs overlay. It
+// holds only the paths that have actually been created or modified through the overlay; every
+// other path is left to fall through to the overlay's read-only original tree. Implementations
+// may be in-memory (tests, short-lived overlays) or back onto local disk (larger, longer-lived
+// ones).
+//
+// Paths are slash-separated and relative to the overlay root; "" denotes the root itself.
+type WriteStore interface {
+	// Create creates or truncates the regular file at p and returns a writer for its content.
+	// Parent directories need not already exist in the store; Create implicitly creates them.
+	Create(ctx context.Context, p string) (io.WriteCloser, error)
+	// Mkdir creates the directory at p, implicitly creating parents.
+	Mkdir(ctx context.Context, p string) error
+	// Open opens the regular file previously written at p.
+	Open(ctx context.Context, p string) (io.ReadCloser, error)
+	// Stat returns info for a path previously written via Create or Mkdir. It returns an error
+	// satisfying errors.Is(err, fs.ErrNotExist) if p hasn't been written.
+	Stat(ctx context.Context, p string) (fsnode.FileInfo, error)
+	// List returns the base names of the direct children that have been written to the store
+	// under dir (directly, or as an ancestor of a written path).
+	List(ctx context.Context, dir string) ([]string, error)
+	// Remove deletes the file or (recursively) directory previously written at p. It returns an
+	// error satisfying errors.Is(err, fs.ErrNotExist) if p hasn't been written.
+	Remove(ctx context.Context, p string) error
+}
+
+var (
+	// ErrIsDirectory is returned by Rename and AddChildLeaf when the destination exists and is a
+	// directory.
+	ErrIsDirectory = errors.New("addfs: destination is a directory")
+	// ErrSelfDescendant is returned by Rename when the destination would be a descendant of the
+	// node being renamed, which would make the node its own ancestor.
+	ErrSelfDescendant = errors.New("addfs: cannot rename a directory into its own descendant")
+)
+
+// WritableApplyPerNodeFuncs is like ApplyPerNodeFuncs, but the returned tree also supports
+// writes (AddChildLeaf, AddChildParent, RemoveChild, and OverlayParent.Rename): writes to any path under original land in store rather than
+// mutating original (which ApplyPerNodeFuncs, like the rest of fsnode, treats as read-only), and
+// reads prefer the overlay, falling through to original where the overlay hasn't been touched.
+// Since fns are applied via ApplyPerNodeFuncs on top of the overlaid view (not on original
+// directly), their "..." additions stay consistent as the overlay is written to.
+func WritableApplyPerNodeFuncs(original fsnode.Parent, store WriteStore, fns ...PerNodeFunc) *OverlayParent {
+	root := &overlayRoot{original: original, store: store}
+	base := &overlayBase{FileInfo: fsnode.CopyFileInfo(original.Info()), root: root, path: ""}
+	return &OverlayParent{Parent: ApplyPerNodeFuncs(base, fns...), base: base}
+}
+
+// OverlayParent is the result of WritableApplyPerNodeFuncs: a writable, PerNodeFunc-augmented
+// view of a read-only fsnode.Parent.
+type OverlayParent struct {
+	fsnode.Parent
+	base *overlayBase
+}
+
+// Snapshot replays the mutations recorded by the overlay (writes, directory creates, and
+// removes, including the whiteouts Rename and Remove leave behind) into w. Only each path's last
+// mutation is replayed, and a remove also drops earlier mutations of the removed path's
+// descendants. Paths are replayed shallower before deeper, in lexical order at equal depth,
+// whatever their kind of mutation.
+func (o *OverlayParent) Snapshot(ctx context.Context, w ManifestWriter) error {
+	return o.base.root.snapshot(ctx, w)
+}
+
+// Rename moves the node at oldPath to newPath, both slash-separated and relative to the overlay
+// root. See overlayBase.Rename.
+func (o *OverlayParent) Rename(ctx context.Context, oldPath, newPath string) error {
+	return o.base.Rename(ctx, oldPath, o.base, newPath)
+}
+
+// Sync flushes any writes the overlay's WriteStore has buffered. It's a no-op unless store
+// implements `Sync(context.Context) error` itself.
+func (o *OverlayParent) Sync(ctx context.Context) error {
+	if s, ok := o.base.root.store.(interface{ Sync(context.Context) error }); ok {
+		return s.Sync(ctx)
+	}
+	return nil
+}
+
+// ManifestWriter receives an overlay's recorded mutations during Snapshot. Callers supply an
+// implementation that serializes these into their own manifest format.
+type ManifestWriter interface {
+	WriteFile(ctx context.Context, path string, r io.Reader) error
+	Mkdir(ctx context.Context, path string) error
+	Remove(ctx context.Context, path string) error
+}
+
+type mutationKind int
+
+const (
+	mutationWrite mutationKind = iota
+	mutationMkdir
+	mutationRemove
+)
+
+// overlayRoot is the state shared by every node (overlayBase, overlayLeaf) in one overlay tree.
+type overlayRoot struct {
+	original fsnode.Parent
+	store    WriteStore
+
+	mu        sync.Mutex
+	whiteouts map[string]bool // paths removed relative to original, not (or no longer) in store
+	log       []mutation      // chronological record of writes, for Snapshot
+}
+
+type mutation struct {
+	path string
+	kind mutationKind
+}
+
+func (r *overlayRoot) record(p string, kind mutationKind) {
+	r.mu.Lock()
+	r.log = append(r.log, mutation{p, kind})
+	r.mu.Unlock()
+}
+
+func (r *overlayRoot) setWhiteout(p string) {
+	r.mu.Lock()
+	if r.whiteouts == nil {
+		r.whiteouts = make(map[string]bool)
+	}
+	r.whiteouts[p] = true
+	r.mu.Unlock()
+	r.record(p, mutationRemove)
+}
+
+func (r *overlayRoot) clearWhiteout(p string) {
+	r.mu.Lock()
+	delete(r.whiteouts, p)
+	r.mu.Unlock()
+}
+
+func (r *overlayRoot) isWhiteout(p string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.whiteouts[p]
+}
+
+// resolve looks up p, preferring the store, then checking for a whiteout, then falling through
+// to original.
+func (r *overlayRoot) resolve(ctx context.Context, p string) (fsnode.T, error) {
+	if info, err := r.store.Stat(ctx, p); err == nil {
+		return r.nodeFromStore(p, info), nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if r.isWhiteout(p) {
+		return nil, fs.ErrNotExist
+	}
+	return r.resolveOriginal(ctx, p)
+}
+
+func (r *overlayRoot) nodeFromStore(p string, info fsnode.FileInfo) fsnode.T {
+	if info.IsDir() {
+		return &overlayBase{FileInfo: info, root: r, path: p}
+	}
+	return overlayLeaf{FileInfo: info, root: r, path: p}
+}
+
+// resolveOriginal walks original from the root, one path component at a time, and wraps the
+// result (if found) for use within the overlay.
+func (r *overlayRoot) resolveOriginal(ctx context.Context, p string) (fsnode.T, error) {
+	if p == "" {
+		return r.wrapOriginal(p, r.original), nil
+	}
+	parent, ok, err := r.originalParentAt(ctx, path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	child, err := parent.Child(ctx, path.Base(p))
+	if err != nil {
+		return nil, err
+	}
+	return r.wrapOriginal(p, child), nil
+}
+
+// originalParentAt returns the fsnode.Parent within original at dir ("." or "" for the root).
+func (r *overlayRoot) originalParentAt(ctx context.Context, dir string) (fsnode.Parent, bool, error) {
+	if dir == "" || dir == "." {
+		return r.original, true, nil
+	}
+	n, err := r.resolveOriginal(ctx, dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	parent, ok := n.(fsnode.Parent)
+	if !ok {
+		return nil, false, nil
+	}
+	return parent, true, nil
+}
+
+func (r *overlayRoot) wrapOriginal(p string, node fsnode.T) fsnode.T {
+	switch n := node.(type) {
+	case fsnode.Parent:
+		return &overlayBase{FileInfo: fsnode.CopyFileInfo(n.Info()), root: r, path: p}
+	case fsnode.Leaf:
+		return overlayLeaf{FileInfo: fsnode.CopyFileInfo(n.Info()), root: r, path: p, original: n}
+	default:
+		return node // neither Parent nor Leaf: pass through as-is.
+	}
+}
+
+// copyUp materializes the node at oldPath (wherever it currently resolves from) into the store at
+// newPath. Rename uses this rather than a cheap pointer move because the store has no way to
+// represent "this path is really just an alias for that one" — and because original is assumed
+// read-only, a rename sourced from it has no choice but to copy its content into the writable
+// layer.
+func (r *overlayRoot) copyUp(ctx context.Context, oldPath, newPath string) error {
+	node, err := r.resolve(ctx, oldPath)
+	if err != nil {
+		return err
+	}
+	if node.Info().IsDir() {
+		if err := r.store.Mkdir(ctx, newPath); err != nil {
+			return err
+		}
+		r.record(newPath, mutationMkdir)
+		it := node.(fsnode.Parent).Children()
+		for {
+			child, err := it.Next(ctx)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			name := child.Info().Name()
+			if err := r.copyUp(ctx, path.Join(oldPath, name), path.Join(newPath, name)); err != nil {
+				return err
+			}
+		}
+	}
+	leaf, ok := node.(fsnode.Leaf)
+	if !ok {
+		return fmt.Errorf("addfs: rename: %s is neither a directory nor a regular file", oldPath)
+	}
+	src, err := fsnode.Open(ctx, leaf)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close(ctx) }()
+	dst, err := r.store.Create(ctx, newPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, ioctx.ToStdReader(ctx, src)); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	r.record(newPath, mutationWrite)
+	return nil
+}
+
+// removePath deletes p from the store (if present) and leaves a whiteout so resolve won't fall
+// through to original.
+func (r *overlayRoot) removePath(ctx context.Context, p string) error {
+	if _, err := r.resolve(ctx, p); err != nil {
+		return err
+	}
+	if err := r.store.Remove(ctx, p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	r.setWhiteout(p)
+	return nil
+}
+
+func (r *overlayRoot) snapshot(ctx context.Context, w ManifestWriter) error {
+	r.mu.Lock()
+	log := append([]mutation(nil), r.log...)
+	r.mu.Unlock()
+
+	// final holds each path's last-applicable mutation. A remove of a directory also drops any
+	// previously recorded mutation to its descendants, since WriteStore.Remove deletes them too:
+	// without this, a write-then-remove-the-whole-directory sequence would leave stale
+	// mutationWrite entries for paths the store no longer has anything at.
+	final := make(map[string]mutationKind, len(log))
+	for _, m := range log {
+		if m.kind == mutationRemove {
+			prefix := m.path + "/"
+			for p := range final {
+				if p == m.path || strings.HasPrefix(p, prefix) {
+					delete(final, p)
+				}
+			}
+		}
+		final[m.path] = m.kind
+	}
+	order := make([]string, 0, len(final))
+	for p := range final {
+		order = append(order, p)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		di, dj := strings.Count(order[i], "/"), strings.Count(order[j], "/")
+		if di != dj {
+			return di < dj
+		}
+		return order[i] < order[j]
+	})
+	for _, p := range order {
+		switch final[p] {
+		case mutationMkdir:
+			if err := w.Mkdir(ctx, p); err != nil {
+				return err
+			}
+		case mutationWrite:
+			rc, err := r.store.Open(ctx, p)
+			if err != nil {
+				return err
+			}
+			err = w.WriteFile(ctx, p, rc)
+			_ = rc.Close()
+			if err != nil {
+				return err
+			}
+		case mutationRemove:
+			if err := w.Remove(ctx, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// overlayBase is a directory within the copy-on-write overlay.
+type overlayBase struct {
+	fsnode.FileInfo
+	root *overlayRoot
+	path string
+}
+
+var (
+	_ fsnode.Parent    = (*overlayBase)(nil)
+	_ fsnode.Cacheable = (*overlayBase)(nil)
+)
+
+func (o *overlayBase) FSNodeT() {}
+
+// CacheableFor is always zero: the overlay can be written to at any time, so nothing under it is
+// safe to cache.
+func (o *overlayBase) CacheableFor() time.Duration { return 0 }
+
+func (o *overlayBase) Child(ctx context.Context, name string) (fsnode.T, error) {
+	return o.root.resolve(ctx, path.Join(o.path, name))
+}
+
+func (o *overlayBase) Children() fsnode.Iterator {
+	return &overlayChildIterator{root: o.root, dir: o.path}
+}
+
+// AddChildLeaf creates (or truncates) the regular file name under o and returns the new leaf
+// alongside an open file for writing its contents. The returned fsctx.File also implements
+// Write(context.Context, []byte) (int, error) (an ioctx.Writer), since fsctx.File itself is
+// read-only; callers that need to write must type-assert for it, the same way callers of
+// io/fs.File type-assert for io.Writer when they know the underlying file supports it.
+func (o *overlayBase) AddChildLeaf(ctx context.Context, name string, flags uint32) (fsnode.Leaf, fsctx.File, error) {
+	p := path.Join(o.path, name)
+	if existing, err := o.root.resolve(ctx, p); err == nil && existing.Info().IsDir() {
+		return nil, nil, ErrIsDirectory
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	w, err := o.root.store.Create(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	o.root.clearWhiteout(p)
+	o.root.record(p, mutationWrite)
+	info := fsnode.NewRegInfo(name)
+	leaf := overlayLeaf{FileInfo: info, root: o.root, path: p}
+	return leaf, &overlayWriteFile{w: w, info: info}, nil
+}
+
+// AddChildParent creates the directory name under o and returns it.
+func (o *overlayBase) AddChildParent(ctx context.Context, name string) (fsnode.Parent, error) {
+	p := path.Join(o.path, name)
+	if _, err := o.root.resolve(ctx, p); err == nil {
+		return nil, fmt.Errorf("addfs: mkdir %s: %w", p, fs.ErrExist)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err := o.root.store.Mkdir(ctx, p); err != nil {
+		return nil, err
+	}
+	o.root.clearWhiteout(p)
+	o.root.record(p, mutationMkdir)
+	return &overlayBase{FileInfo: fsnode.NewDirInfo(name), root: o.root, path: p}, nil
+}
+
+// RemoveChild removes name (recursively, if it's a directory) from o.
+func (o *overlayBase) RemoveChild(ctx context.Context, name string) error {
+	return o.root.removePath(ctx, path.Join(o.path, name))
+}
+
+// Rename moves oldName (a child of o) to newName under newParent, which must be a directory
+// within the same overlay. There's no fsnode.Parent equivalent of this (fsnode trees have no
+// rename concept), so it's only reachable by calling it directly on an *overlayBase, as
+// OverlayParent.Rename does.
+func (o *overlayBase) Rename(ctx context.Context, oldName string, newParent *overlayBase, newName string) error {
+	if newParent.root != o.root {
+		return fmt.Errorf("addfs: rename: destination is not within the same writable overlay")
+	}
+	oldPath := path.Join(o.path, oldName)
+	newPath := path.Join(newParent.path, newName)
+	if newPath == oldPath || strings.HasPrefix(newPath+"/", oldPath+"/") {
+		return ErrSelfDescendant
+	}
+	if existing, err := o.root.resolve(ctx, newPath); err == nil && existing.Info().IsDir() {
+		return ErrIsDirectory
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := o.root.copyUp(ctx, oldPath, newPath); err != nil {
+		return err
+	}
+	return o.root.removePath(ctx, oldPath)
+}
+
+// overlayLeaf is a regular file within the copy-on-write overlay: either backed by the store (if
+// written through the overlay) or, if untouched, by original's corresponding leaf.
+type overlayLeaf struct {
+	fsnode.FileInfo
+	root     *overlayRoot
+	path     string
+	original fsnode.Leaf // non-nil if this leaf hasn't been written to and falls through to original
+}
+
+var _ fsnode.Leaf = overlayLeaf{}
+
+func (l overlayLeaf) FSNodeT() {}
+
+func (l overlayLeaf) OpenFile(ctx context.Context, flag int) (fsctx.File, error) {
+	if l.original != nil {
+		return l.original.OpenFile(ctx, flag)
+	}
+	r, err := l.root.store.Open(ctx, l.path)
+	if err != nil {
+		return nil, err
+	}
+	return &overlayReadFile{r: r, info: l.FileInfo}, nil
+}
+
+// overlayReadFile adapts the io.ReadCloser a WriteStore.Open returns to fsctx.File.
+type overlayReadFile struct {
+	r    io.ReadCloser
+	info fsnode.FileInfo
+}
+
+func (f *overlayReadFile) Stat(context.Context) (os.FileInfo, error) { return f.info, nil }
+func (f *overlayReadFile) Read(_ context.Context, dst []byte) (int, error) { return f.r.Read(dst) }
+func (f *overlayReadFile) Close(context.Context) error { return f.r.Close() }
+
+// overlayWriteFile is the fsctx.File AddChildLeaf returns: it additionally implements
+// Write(context.Context, []byte) (int, error), since fsctx.File alone can't express writing.
+type overlayWriteFile struct {
+	w    io.WriteCloser
+	info fsnode.FileInfo
+}
+
+func (f *overlayWriteFile) Stat(context.Context) (os.FileInfo, error) { return f.info, nil }
+func (f *overlayWriteFile) Read(context.Context, []byte) (int, error) {
+	return 0, fmt.Errorf("addfs: %s: is write-only: %w", f.info.Name(), errors.ErrUnsupported)
+}
+func (f *overlayWriteFile) Write(_ context.Context, p []byte) (int, error) { return f.w.Write(p) }
+func (f *overlayWriteFile) Close(context.Context) error                   { return f.w.Close() }
+
+// overlayChildIterator lists a directory's children: store-introduced or -shadowed names first,
+// then original's remaining, unshadowed, non-whited-out children.
+type overlayChildIterator struct {
+	root *overlayRoot
+	dir  string
+
+	storeNames []string
+	idx        int
+	seen       map[string]bool
+
+	origIter    fsnode.Iterator
+	origChecked bool
+}
+
+func (it *overlayChildIterator) Next(ctx context.Context) (fsnode.T, error) {
+	if it.seen == nil {
+		it.seen = make(map[string]bool)
+		names, err := it.root.store.List(ctx, it.dir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		it.storeNames = names
+	}
+	for it.idx < len(it.storeNames) {
+		name := it.storeNames[it.idx]
+		it.idx++
+		if it.seen[name] {
+			continue
+		}
+		it.seen[name] = true
+		n, err := it.root.resolve(ctx, path.Join(it.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	if !it.origChecked {
+		it.origChecked = true
+		parent, ok, err := it.root.originalParentAt(ctx, it.dir)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			it.origIter = parent.Children()
+		}
+	}
+	if it.origIter == nil {
+		return nil, io.EOF
+	}
+	for {
+		child, err := it.origIter.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		name := child.Info().Name()
+		p := path.Join(it.dir, name)
+		if it.seen[name] || it.root.isWhiteout(p) {
+			continue
+		}
+		it.seen[name] = true
+		return it.root.wrapOriginal(p, child), nil
+	}
+}
+
+func (it *overlayChildIterator) Close(ctx context.Context) error {
+	if it.origIter == nil {
+		return nil
+	}
+	return it.origIter.Close(ctx)
+}
@@ -0,0 +1,189 @@
+package addfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"testing"
+
+	"github.com/grailbio/base/file/fsnode"
+	"github.com/grailbio/base/ioctx"
+)
+
+// memManifest is a ManifestWriter that just records what was written to it, in order, for
+// asserting against in tests.
+type memManifest struct {
+	ops []string
+}
+
+func (m *memManifest) WriteFile(ctx context.Context, path string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.ops = append(m.ops, "write:"+path+":"+string(data))
+	return nil
+}
+
+func (m *memManifest) Mkdir(ctx context.Context, path string) error {
+	m.ops = append(m.ops, "mkdir:"+path)
+	return nil
+}
+
+func (m *memManifest) Remove(ctx context.Context, path string) error {
+	m.ops = append(m.ops, "remove:"+path)
+	return nil
+}
+
+// fileWriter is the subset of fsctx.File that AddChildLeaf's returned file additionally
+// implements, for writing its contents.
+type fileWriter interface {
+	Write(context.Context, []byte) (int, error)
+}
+
+func writeString(t *testing.T, ctx context.Context, p *overlayBase, name, content string) {
+	t.Helper()
+	_, f, err := p.AddChildLeaf(ctx, name, 0)
+	if err != nil {
+		t.Fatalf("AddChildLeaf(%q): %v", name, err)
+	}
+	if _, err := f.(fileWriter).Write(ctx, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverlaySnapshot_RemoveDropsDescendantMutations(t *testing.T) {
+	ctx := context.Background()
+	original := memParent{FileInfo: fsnode.NewDirInfo("root")}
+	store := NewMemWriteStore()
+	overlay := WritableApplyPerNodeFuncs(original, store)
+
+	base := overlay.base
+	if _, err := base.AddChildParent(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	writeString(t, ctx, base, "a/b", "hello")
+	if err := base.RemoveChild(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	var w memManifest
+	if err := overlay.Snapshot(ctx, &w); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	sort.Strings(w.ops)
+	if got, want := w.ops, []string{"remove:a"}; len(got) != len(want) || got[0] != want[0] {
+		t.Errorf("got ops %v, want %v", w.ops, want)
+	}
+}
+
+func TestOverlaySnapshot_WriteAfterRemove(t *testing.T) {
+	ctx := context.Background()
+	original := memParent{FileInfo: fsnode.NewDirInfo("root")}
+	store := NewMemWriteStore()
+	overlay := WritableApplyPerNodeFuncs(original, store)
+
+	base := overlay.base
+	if _, err := base.AddChildParent(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	writeString(t, ctx, base, "a/b", "first")
+	if err := base.RemoveChild(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := base.AddChildParent(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	writeString(t, ctx, base, "a/b", "second")
+
+	var w memManifest
+	if err := overlay.Snapshot(ctx, &w); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	found := false
+	for _, op := range w.ops {
+		if op == "write:a/b:second" {
+			found = true
+		}
+		if op == "write:a/b:first" {
+			t.Errorf("stale write replayed: %v", w.ops)
+		}
+	}
+	if !found {
+		t.Errorf("expected recreated a/b to be replayed, got %v", w.ops)
+	}
+}
+
+func TestOverlayRename_SelfDescendant(t *testing.T) {
+	ctx := context.Background()
+	original := memParent{FileInfo: fsnode.NewDirInfo("root")}
+	store := NewMemWriteStore()
+	overlay := WritableApplyPerNodeFuncs(original, store)
+
+	base := overlay.base
+	if _, err := base.AddChildParent(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := base.AddChildParent(ctx, "a/b"); err != nil {
+		t.Fatal(err)
+	}
+	err := base.Rename(ctx, "a", base, "a/b/c")
+	if !errors.Is(err, ErrSelfDescendant) {
+		t.Errorf("got %v, want ErrSelfDescendant", err)
+	}
+}
+
+func TestOverlayRename_ErrIsDirectory(t *testing.T) {
+	ctx := context.Background()
+	original := memParent{FileInfo: fsnode.NewDirInfo("root")}
+	store := NewMemWriteStore()
+	overlay := WritableApplyPerNodeFuncs(original, store)
+
+	base := overlay.base
+	writeString(t, ctx, base, "file", "hello")
+	if _, err := base.AddChildParent(ctx, "dir"); err != nil {
+		t.Fatal(err)
+	}
+	err := base.Rename(ctx, "file", base, "dir")
+	if !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("got %v, want ErrIsDirectory", err)
+	}
+}
+
+func TestOverlayRename(t *testing.T) {
+	ctx := context.Background()
+	original := memParent{FileInfo: fsnode.NewDirInfo("root")}
+	store := NewMemWriteStore()
+	overlay := WritableApplyPerNodeFuncs(original, store)
+
+	base := overlay.base
+	writeString(t, ctx, base, "file", "hello")
+	if err := base.Rename(ctx, "file", base, "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := base.Child(ctx, "file"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist for old path", err)
+	}
+	node, err := base.Child(ctx, "renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsnode.Open(ctx, node.(fsnode.Leaf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close(ctx) }()
+	got, err := io.ReadAll(ioctx.ToStdReader(ctx, f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("hello")) {
+		t.Errorf("got content %q, want %q", got, "hello")
+	}
+}
@@ -2,11 +2,14 @@ package addfs
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"path"
 	"time"
 
 	"github.com/grailbio/base/file/fsnode"
-	"github.com/grailbio/base/log"
 )
 
 type (
@@ -51,10 +54,13 @@ type (
 	// children directly under /.../file/ for convenient access. However, Funcs that are expensive,
 	// for example reading some file contents, etc., may want to separate themselves under their own
 	// subdirectory, like .../file/func_name/. This lets users browsing the tree "opt-in" to seeing
-	// the results of the expensive computation by navigating to .../file/func_name/.
+	// the results of the expensive computation by navigating to .../file/func_name/. For funcs that
+	// are expensive enough to need it, ApplyPerNodeFuncsWithOptions's Cache and MaxConcurrency can
+	// further soften the cost of browsing.
 	//
-	// If the input tree has any "..." that conflict with the added ones, the added ones override.
-	// The originals will simply not be accessible.
+	// If the input tree has any "..." that conflict with the added ones, or if multiple fns add
+	// the same name, ApplyPerNodeFuncsWithOptions's ConflictPolicy decides what happens (by
+	// default, ConflictLastWins: the added ones override, and the original is not accessible).
 	PerNodeFunc interface {
 		Apply(context.Context, fsnode.T) (adds []fsnode.T, _ error)
 	}
@@ -68,10 +74,39 @@ func (f perNodeFunc) Apply(ctx context.Context, n fsnode.T) ([]fsnode.T, error)
 
 const addsDirName = "..."
 
+// perNodeState is the configuration and shared resources (the concurrency semaphore, the cache)
+// for one ApplyPerNodeFuncsWithOptions call, carried through every node of the resulting tree
+// (including recursion into subdirectories) so they all draw from the same budget and cache.
+type perNodeState struct {
+	fns        []PerNodeFunc
+	sem        semaphore
+	cache      Cache
+	staleAfter time.Duration
+	conflict   ConflictPolicy
+	nameSubst  NameSubstituter
+}
+
+// conflictPolicy returns st.conflict, defaulting to ConflictLastWins.
+func (st *perNodeState) conflictPolicy() ConflictPolicy {
+	if st.conflict != nil {
+		return st.conflict
+	}
+	return ConflictLastWins
+}
+
+// substituter returns st.nameSubst, defaulting to defaultNameSubstituter.
+func (st *perNodeState) substituter() NameSubstituter {
+	if st.nameSubst != nil {
+		return st.nameSubst
+	}
+	return defaultNameSubstituter
+}
+
 // perNodeImpl extends the original Parent with the .../ child.
 type perNodeImpl struct {
 	fsnode.Parent
-	fns  []PerNodeFunc
+	path string
+	st   *perNodeState
 	adds fsnode.Parent
 }
 
@@ -84,44 +119,145 @@ var (
 // See PerNodeFunc's for more documentation on how this works.
 // Later fns's added nodes will overwrite earlier ones, if any names conflict.
 func ApplyPerNodeFuncs(original fsnode.Parent, fns ...PerNodeFunc) fsnode.Parent {
-	fns = append([]PerNodeFunc{}, fns...)
-	adds := perNodeAdds{
+	return ApplyPerNodeFuncsWithOptions(original, PerNodeFuncOptions{}, fns...)
+}
+
+// ApplyPerNodeFuncsWithOptions is like ApplyPerNodeFuncs, but with control over how expensive fns
+// are invoked: opts.MaxConcurrency bounds how many Apply calls run at once across the whole
+// resulting tree, and opts.Cache (with opts.StaleAfter) memoizes Apply results so that repeatedly
+// listing the same directory doesn't repeatedly pay for it.
+func ApplyPerNodeFuncsWithOptions(original fsnode.Parent, opts PerNodeFuncOptions, fns ...PerNodeFunc) fsnode.Parent {
+	st := &perNodeState{
+		fns:        append([]PerNodeFunc{}, fns...),
+		sem:        newSemaphore(opts.MaxConcurrency),
+		cache:      opts.Cache,
+		staleAfter: opts.StaleAfter,
+		conflict:   opts.ConflictPolicy,
+		nameSubst:  opts.NameSubstituter,
+	}
+	return newPerNode(original, "", st)
+}
+
+func newPerNode(original fsnode.Parent, nodePath string, st *perNodeState) fsnode.Parent {
+	adds := &perNodeAdds{
 		FileInfo: fsnode.CopyFileInfo(original.Info()).WithName(addsDirName),
 		original: original,
-		fns:      fns,
+		path:     nodePath,
+		st:       st,
 	}
-	return &perNodeImpl{original, fns, &adds}
+	return &perNodeImpl{original, nodePath, st, adds}
 }
 
 func (n *perNodeImpl) CacheableFor() time.Duration { return fsnode.CacheableFor(n.Parent) }
 func (n *perNodeImpl) Child(ctx context.Context, name string) (fsnode.T, error) {
 	if name == addsDirName {
-		return n.adds, nil
+		return n.resolveAddsConflict(ctx)
 	}
 	child, err := n.Parent.Child(ctx, name)
 	if err != nil {
 		return nil, err
 	}
-	return perNodeRecurse(child, n.fns), nil
+	return perNodeRecurse(child, path.Join(n.path, name), n.st), nil
 }
 func (n *perNodeImpl) Children() fsnode.Iterator {
-	return fsnode.NewConcatIterator(
-		// TODO: Consider omitting .../ if the directory has no other children.
-		fsnode.NewIterator(n.adds),
-		// TODO: Filter out any conflicting ... to be consistent with Child.
-		fsnode.MapIterator(n.Parent.Children(), func(_ context.Context, child fsnode.T) (fsnode.T, error) {
-			return perNodeRecurse(child, n.fns), nil
-		}),
-	)
+	return &perNodeChildIterator{impl: n}
+}
+
+// resolveAddsConflict returns what .../ should resolve to: n.adds, unless the original tree also
+// has a child literally named "...", in which case n.st's ConflictPolicy decides between them.
+func (n *perNodeImpl) resolveAddsConflict(ctx context.Context) (fsnode.T, error) {
+	orig, err := n.Parent.Child(ctx, addsDirName)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return n.adds, nil
+		}
+		return nil, err
+	}
+	resolved, err := mergeByName(ctx, n.st.conflictPolicy(), map[string][]fsnode.T{addsDirName: {orig, n.adds}})
+	if err != nil {
+		return nil, err
+	}
+	// Child(ctx, addsDirName) can only return a single node for the single name addsDirName:
+	// unlike newAddsForChild's per-child adds (which live under a .../<child>/ directory that has
+	// room for suffixed siblings like name.1), there's no containing directory here to expose any
+	// extra name a multi-way ConflictMerge might produce. So if the original tree's own "..." isn't
+	// itself mergeable (e.g. it's a plain file), resolved can come back with more than one entry;
+	// silently picking one of them would be exactly the silent drop ConflictPolicy exists to avoid.
+	if len(resolved) != 1 {
+		return nil, fmt.Errorf("addfs: %s conflicts with the input tree's own %q in a way its ConflictPolicy can't resolve to a single node (produced %d)", addsDirName, addsDirName, len(resolved))
+	}
+	if node, ok := resolved[addsDirName]; ok {
+		return node, nil
+	}
+	return nil, fmt.Errorf("addfs: resolving %s conflict produced no result", addsDirName)
+}
+
+// perNodeChildIterator lazily resolves the .../ vs. original-"..." conflict (if any) on first
+// Next, then streams .../ followed by the original's other children (skipping any literal "..."
+// entry, which resolveAddsConflict already accounted for).
+type perNodeChildIterator struct {
+	impl  *perNodeImpl
+	inner fsnode.Iterator
+}
+
+func (it *perNodeChildIterator) Next(ctx context.Context) (fsnode.T, error) {
+	if it.inner == nil {
+		adds, err := it.impl.resolveAddsConflict(ctx)
+		if err != nil {
+			return nil, err
+		}
+		it.inner = fsnode.NewConcatIterator(
+			// TODO: Consider omitting .../ if the directory has no other children.
+			fsnode.NewIterator(adds),
+			fsnode.MapIterator(
+				&filterIterator{
+					inner: it.impl.Parent.Children(),
+					keep:  func(child fsnode.T) bool { return child.Info().Name() != addsDirName },
+				},
+				func(_ context.Context, child fsnode.T) (fsnode.T, error) {
+					return perNodeRecurse(child, path.Join(it.impl.path, child.Info().Name()), it.impl.st), nil
+				},
+			),
+		)
+	}
+	return it.inner.Next(ctx)
+}
+
+func (it *perNodeChildIterator) Close(ctx context.Context) error {
+	if it.inner == nil {
+		return nil
+	}
+	return it.inner.Close(ctx)
+}
+
+// filterIterator wraps inner, skipping nodes for which keep returns false.
+type filterIterator struct {
+	inner fsnode.Iterator
+	keep  func(fsnode.T) bool
+}
+
+func (it *filterIterator) Next(ctx context.Context) (fsnode.T, error) {
+	for {
+		n, err := it.inner.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if it.keep(n) {
+			return n, nil
+		}
+	}
 }
 
+func (it *filterIterator) Close(ctx context.Context) error { return it.inner.Close(ctx) }
+
 // perNodeAdds is the .../ Parent. It has a child (directory) for each original child (both
 // directories and files). The children contain the PerNodeFunc.Apply outputs.
 type perNodeAdds struct {
 	fsnode.ParentReadOnly
 	fsnode.FileInfo
 	original fsnode.Parent
-	fns      []PerNodeFunc
+	path     string
+	st       *perNodeState
 }
 
 var (
@@ -134,53 +270,145 @@ func (n *perNodeAdds) Child(ctx context.Context, name string) (fsnode.T, error)
 	if err != nil {
 		return nil, err
 	}
-	return n.newAddsForChild(child), nil
+	return n.newAddsForChild(child, path.Join(n.path, name)), nil
 }
 func (n *perNodeAdds) Children() fsnode.Iterator {
-	// TODO: Filter out any conflicting ... to be consistent with Child.
 	return fsnode.MapIterator(n.original.Children(), func(_ context.Context, child fsnode.T) (fsnode.T, error) {
-		return n.newAddsForChild(child), nil
+		return n.newAddsForChild(child, path.Join(n.path, child.Info().Name())), nil
 	})
 }
 func (n *perNodeAdds) FSNodeT() {}
 
-func (n *perNodeAdds) newAddsForChild(original fsnode.T) fsnode.Parent {
+func (n *perNodeAdds) newAddsForChild(original fsnode.T, childPath string) fsnode.Parent {
 	originalInfo := original.Info()
-	return fsnode.NewParent(
-		fsnode.NewDirInfo(originalInfo.Name()).
+	return &perNodeChildAdds{
+		FileInfo: fsnode.NewDirInfo(originalInfo.Name()).
 			WithModTime(originalInfo.ModTime()).
 			// Derived directory must be executable to be usable, even if original file wasn't.
 			WithModePerm(originalInfo.Mode().Perm()|0111).
 			WithCacheableFor(fsnode.CacheableFor(original)),
-		fsnode.FuncChildren(func(ctx context.Context) ([]fsnode.T, error) {
-			adds := make(map[string]fsnode.T)
-			for _, fn := range n.fns {
-				fnAdds, err := fn.Apply(ctx, original)
-				if err != nil {
-					return nil, fmt.Errorf("addfs: error running func %v: %w", fn, err)
-				}
-				for _, add := range fnAdds {
-					name := add.Info().Name()
-					if _, exists := adds[name]; exists {
-						// TODO: Consider returning an error here. Or merging the added trees?
-						log.Error.Printf("addfs %s: conflict for added name: %s", originalInfo.Name(), name)
-					}
-					adds[name] = add
-				}
-			}
-			wrapped := make([]fsnode.T, 0, len(adds))
-			for _, add := range adds {
-				wrapped = append(wrapped, perNodeRecurse(add, n.fns))
+		adds:      n,
+		original:  original,
+		childPath: childPath,
+	}
+}
+
+// perNodeChildAdds is a single .../<child>/ Parent: the PerNodeFunc.Apply results for one
+// original child, keyed by their (name-substituted, conflict-resolved) names. It computes those
+// results itself, rather than via fsnode.NewParent/FuncChildren, so that Child(ctx, name) can look
+// a name up directly against the same substituted keys Children() reports, rather than only
+// finding it via a full Children() scan.
+type perNodeChildAdds struct {
+	fsnode.ParentReadOnly
+	fsnode.FileInfo
+	adds      *perNodeAdds
+	original  fsnode.T
+	childPath string
+}
+
+func (a *perNodeChildAdds) FSNodeT() {}
+
+func (a *perNodeChildAdds) compute(ctx context.Context) (map[string]fsnode.T, error) {
+	n := a.adds
+	groups := make(map[string][]fsnode.T)
+	for i, fn := range n.st.fns {
+		fnAdds, err := n.applyOne(ctx, i, fn, a.original, a.childPath)
+		if err != nil {
+			return nil, fmt.Errorf("addfs: error running func %v: %w", fn, err)
+		}
+		for _, add := range fnAdds {
+			name, err := n.st.substituter().Substitute(add.Info().Name())
+			if err != nil {
+				return nil, fmt.Errorf("addfs: %s: %w", a.original.Info().Name(), err)
 			}
-			return wrapped, nil
-		}),
-	)
+			groups[name] = append(groups[name], renameNode(add, name))
+		}
+	}
+	resolved, err := mergeByName(ctx, n.st.conflictPolicy(), groups)
+	if err != nil {
+		return nil, fmt.Errorf("addfs: %s: %w", a.original.Info().Name(), err)
+	}
+	wrapped := make(map[string]fsnode.T, len(resolved))
+	for name, add := range resolved {
+		wrapped[name] = perNodeRecurse(renameNode(add, name), path.Join(a.childPath, addsDirName, name), n.st)
+	}
+	return wrapped, nil
+}
+
+func (a *perNodeChildAdds) Child(ctx context.Context, name string) (fsnode.T, error) {
+	adds, err := a.compute(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if add, ok := adds[name]; ok {
+		return add, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+func (a *perNodeChildAdds) Children() fsnode.Iterator {
+	return &perNodeChildAddsIterator{a: a}
+}
+
+// perNodeChildAddsIterator computes a's adds once, lazily, on the first Next call.
+type perNodeChildAddsIterator struct {
+	a       *perNodeChildAdds
+	fetched bool
+	adds    []fsnode.T
+	idx     int
+}
+
+func (it *perNodeChildAddsIterator) Next(ctx context.Context) (fsnode.T, error) {
+	if !it.fetched {
+		resolved, err := it.a.compute(ctx)
+		if err != nil {
+			return nil, err
+		}
+		it.adds = make([]fsnode.T, 0, len(resolved))
+		for _, add := range resolved {
+			it.adds = append(it.adds, add)
+		}
+		it.fetched = true
+	}
+	if it.idx >= len(it.adds) {
+		return nil, io.EOF
+	}
+	add := it.adds[it.idx]
+	it.idx++
+	return add, nil
+}
+
+func (it *perNodeChildAddsIterator) Close(context.Context) error { return nil }
+
+// applyOne runs a single PerNodeFunc against original, going through n.st's semaphore and cache
+// (if configured).
+func (n *perNodeAdds) applyOne(
+	ctx context.Context, fnIndex int, fn PerNodeFunc, original fsnode.T, childPath string,
+) ([]fsnode.T, error) {
+	compute := func(ctx context.Context) ([]fsnode.T, error) {
+		if err := n.st.sem.acquire(ctx); err != nil {
+			return nil, err
+		}
+		defer n.st.sem.release()
+		return fn.Apply(ctx, original)
+	}
+	if n.st.cache == nil {
+		return compute(ctx)
+	}
+	key := CacheKey{FuncIndex: fnIndex, NodePath: childPath, ModTime: original.Info().ModTime()}
+	return n.st.cache.GetOrCompute(ctx, key, func(ctx context.Context) ([]fsnode.T, time.Duration, error) {
+		adds, err := compute(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		return adds, cacheTTL(original, adds, n.st.staleAfter), nil
+	})
 }
 
-func perNodeRecurse(node fsnode.T, fns []PerNodeFunc) fsnode.T {
+func perNodeRecurse(node fsnode.T, nodePath string, st *perNodeState) fsnode.T {
 	parent, ok := node.(fsnode.Parent)
 	if !ok {
 		return node
 	}
-	return ApplyPerNodeFuncs(parent, fns...)
+	return newPerNode(parent, nodePath, st)
 }
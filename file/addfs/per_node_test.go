@@ -0,0 +1,185 @@
+package addfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/base/file/fsnode"
+)
+
+// newMemLeaf is a minimal fsnode.Leaf backed by an in-memory byte slice, for testing.
+func newMemLeaf(name string, data []byte) fsnode.Leaf {
+	return fsnode.ConstLeaf(fsnode.NewRegInfo(name), data)
+}
+
+// dirNode is a minimal fsnode.Parent with a fixed, named set of children, for testing.
+type dirNode struct {
+	fsnode.ParentReadOnly
+	fsnode.FileInfo
+	children map[string]fsnode.T
+}
+
+func (d dirNode) FSNodeT() {}
+func (d dirNode) Child(_ context.Context, name string) (fsnode.T, error) {
+	if c, ok := d.children[name]; ok {
+		return c, nil
+	}
+	return nil, fs.ErrNotExist
+}
+func (d dirNode) Children() fsnode.Iterator {
+	nodes := make([]fsnode.T, 0, len(d.children))
+	for _, c := range d.children {
+		nodes = append(nodes, c)
+	}
+	return fsnode.NewIterator(nodes...)
+}
+
+// TestResolveAddsConflict_LiteralDotsFile covers the case where the input tree has its own literal
+// "..." entry that's a regular file (not a directory), so ConflictMerge can't fold it into the
+// added .../ and instead produces two results ("..." and "....1"). Since Child(ctx, "...") can
+// only return one node for that one name, this should surface as a clear error rather than
+// silently keeping just one of the two.
+func TestResolveAddsConflict_LiteralDotsFile(t *testing.T) {
+	ctx := context.Background()
+	original := dirNode{
+		FileInfo: fsnode.NewDirInfo("root"),
+		children: map[string]fsnode.T{
+			addsDirName: newMemLeaf(addsDirName, []byte("not a directory")),
+		},
+	}
+	tree := ApplyPerNodeFuncsWithOptions(original, PerNodeFuncOptions{ConflictPolicy: ConflictMerge})
+	_, err := tree.Child(ctx, addsDirName)
+	if err == nil {
+		t.Fatal("expected an error resolving the \"...\" conflict, got nil")
+	}
+}
+
+// TestResolveAddsConflict_MergesDirectory covers the common case where the input tree's own "..."
+// is itself a directory: ConflictMerge should fold it with the synthetic adds directory into a
+// single merged Parent, with no error.
+func TestResolveAddsConflict_MergesDirectory(t *testing.T) {
+	ctx := context.Background()
+	original := dirNode{
+		FileInfo: fsnode.NewDirInfo("root"),
+		children: map[string]fsnode.T{
+			addsDirName: dirNode{
+				FileInfo: fsnode.NewDirInfo(addsDirName),
+				children: map[string]fsnode.T{
+					"preexisting": newMemLeaf("preexisting", []byte("hello")),
+				},
+			},
+		},
+	}
+	tree := ApplyPerNodeFuncsWithOptions(original, PerNodeFuncOptions{ConflictPolicy: ConflictMerge})
+	node, err := tree.Child(ctx, addsDirName)
+	if err != nil {
+		t.Fatalf("Child(%q): %v", addsDirName, err)
+	}
+	parent, ok := node.(fsnode.Parent)
+	if !ok {
+		t.Fatalf("%s: got %T, want fsnode.Parent", addsDirName, node)
+	}
+	if _, err := parent.Child(ctx, "preexisting"); err != nil {
+		t.Errorf("preexisting: %v", err)
+	}
+}
+
+// TestApplyPerNodeFuncsWithOptions_MaxConcurrency checks that MaxConcurrency actually bounds how
+// many PerNodeFunc.Apply calls run at once across the tree, not just per directory.
+func TestApplyPerNodeFuncsWithOptions_MaxConcurrency(t *testing.T) {
+	ctx := context.Background()
+	children := make(map[string]fsnode.T, 5)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		children[name] = newMemLeaf(name, []byte(name))
+	}
+	original := dirNode{FileInfo: fsnode.NewDirInfo("root"), children: children}
+
+	var mu sync.Mutex
+	current, peak := 0, 0
+	fn := NewPerNodeFunc(func(ctx context.Context, n fsnode.T) ([]fsnode.T, error) {
+		mu.Lock()
+		current++
+		if current > peak {
+			peak = current
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		current--
+		mu.Unlock()
+		return nil, nil
+	})
+
+	tree := ApplyPerNodeFuncsWithOptions(original, PerNodeFuncOptions{MaxConcurrency: 2}, fn)
+	adds, err := tree.Child(ctx, addsDirName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addsParent := adds.(fsnode.Parent)
+
+	var wg sync.WaitGroup
+	for name := range children {
+		name := name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			childAdds, err := addsParent.Child(ctx, name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			it := childAdds.(fsnode.Parent).Children()
+			for {
+				if _, err := it.Next(ctx); err == io.EOF {
+					return
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if peak > 2 {
+		t.Errorf("got peak concurrency %d, want <= 2", peak)
+	}
+}
+
+// TestNewAddsForChild_NameSubstitution checks that a PerNodeFunc's added name containing a path
+// separator is sanitized by the default NameSubstituter before it's exposed, and resolves back
+// under its substituted name.
+func TestNewAddsForChild_NameSubstitution(t *testing.T) {
+	ctx := context.Background()
+	original := dirNode{
+		FileInfo: fsnode.NewDirInfo("root"),
+		children: map[string]fsnode.T{
+			"file": newMemLeaf("file", []byte("x")),
+		},
+	}
+	fn := NewPerNodeFunc(func(context.Context, fsnode.T) ([]fsnode.T, error) {
+		return []fsnode.T{newMemLeaf("a/b", []byte("data"))}, nil
+	})
+	tree := ApplyPerNodeFuncsWithOptions(original, PerNodeFuncOptions{}, fn)
+	adds, err := tree.Child(ctx, addsDirName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileAdds, err := adds.(fsnode.Parent).Child(ctx, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := fileAdds.(fsnode.Parent).Child(ctx, "a_b")
+	if err != nil {
+		t.Fatalf("Child(%q): %v", "a_b", err)
+	}
+	if got, want := node.Info().Name(), "a_b"; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+}